@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Token scopes. admin grants every other scope.
+const (
+	scopeUpload   = "upload"
+	scopeList     = "list"
+	scopeDownload = "download"
+	scopeDelete   = "delete"
+	scopeAdmin    = "admin"
+)
+
+var knownScopes = []string{scopeUpload, scopeList, scopeDownload, scopeDelete, scopeAdmin}
+
+// minTokenLength keeps guessable secrets out of the token list.
+const minTokenLength = 16
+
+// apiToken is a static bearer token. A token with a Prefix only sees and
+// touches stored names below that directory, and files it uploads without
+// naming them are stored there.
+type apiToken struct {
+	Name   string
+	Scopes []string
+	Prefix string
+}
+
+func (t *apiToken) has(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, scopeAdmin)
+}
+
+// allows reports whether the token may access the stored name or
+// collection name. A nil token (authentication disabled) allows anything.
+func (t *apiToken) allows(name string) bool {
+	return t == nil || t.Prefix == "" || name == t.Prefix || strings.HasPrefix(name, t.Prefix+"/")
+}
+
+// parseTokens reads token definitions, one per line (or separated by ";"):
+//
+//	name secret scope[,scope...] [prefix]
+//
+// Blank lines and lines starting with # are ignored.
+func parseTokens(r io.Reader) (map[[sha256.Size]byte]*apiToken, error) {
+	tokens := map[[sha256.Size]byte]*apiToken{}
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		for _, def := range strings.Split(scanner.Text(), ";") {
+			fields := strings.Fields(def)
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			if len(fields) < 3 || len(fields) > 4 {
+				return nil, fmt.Errorf("line %d: expected name, secret, scopes and an optional prefix", line)
+			}
+			token := &apiToken{Name: fields[0], Scopes: strings.Split(fields[2], ",")}
+			for _, scope := range token.Scopes {
+				if !slices.Contains(knownScopes, scope) {
+					return nil, fmt.Errorf("line %d: unknown scope %q", line, scope)
+				}
+			}
+			if len(fields) == 4 {
+				token.Prefix = strings.Trim(fields[3], "/")
+				if !validStoredName(token.Prefix) {
+					return nil, fmt.Errorf("line %d: invalid prefix %q", line, fields[3])
+				}
+			}
+			if len(fields[1]) < minTokenLength {
+				return nil, fmt.Errorf("line %d: token %s is shorter than %d characters", line, token.Name, minTokenLength)
+			}
+			key := sha256.Sum256([]byte(fields[1]))
+			if names[token.Name] || tokens[key] != nil {
+				return nil, fmt.Errorf("line %d: duplicate token %s", line, token.Name)
+			}
+			names[token.Name] = true
+			tokens[key] = token
+		}
+	}
+	return tokens, scanner.Err()
+}
+
+// authenticator checks bearer tokens against the configured list, or as
+// JWTs when jwt is set, and the scope each route needs. With neither
+// configured, everything is open.
+type authenticator struct {
+	tokens map[[sha256.Size]byte]*apiToken
+	jwt    *jwtVerifier
+}
+
+// newAuthenticator loads tokens from the AUTH_TOKENS_FILE file and the
+// AUTH_TOKENS value.
+func newAuthenticator(file, inline string) (*authenticator, error) {
+	a := &authenticator{tokens: map[[sha256.Size]byte]*apiToken{}}
+	if err := a.add("AUTH_TOKENS", strings.NewReader(inline)); err != nil {
+		return nil, err
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := a.add(file, f); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *authenticator) add(source string, r io.Reader) error {
+	tokens, err := parseTokens(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	for key, token := range tokens {
+		if a.tokens[key] != nil {
+			return fmt.Errorf("%s: token %s is also defined elsewhere", source, token.Name)
+		}
+		a.tokens[key] = token
+	}
+	return nil
+}
+
+func (a *authenticator) enabled() bool {
+	return len(a.tokens) > 0 || a.jwt != nil
+}
+
+// lookup returns the token sent with r, from an Authorization header with
+// a Bearer token or, for WebDAV clients, a Basic password. Secrets shaped
+// like a JWT are verified as one when OIDC is configured.
+func (a *authenticator) lookup(r *http.Request) (*apiToken, bool) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, secret, ok = r.BasicAuth()
+	}
+	secret = strings.TrimSpace(secret)
+	if !ok || secret == "" {
+		return nil, false
+	}
+	if a.jwt != nil && strings.Count(secret, ".") == 2 {
+		token, err := a.jwt.verify(secret)
+		if err != nil {
+			log.Printf("Rejected JWT from %s: %v", r.RemoteAddr, err)
+			return nil, false
+		}
+		return token, true
+	}
+	// Map lookups by hash don't leak how much of a secret matched
+	token := a.tokens[sha256.Sum256([]byte(secret))]
+	return token, token != nil
+}
+
+type tokenKey struct{}
+
+// requestToken returns the token r was authenticated with, or nil when
+// authentication is disabled.
+func requestToken(r *http.Request) *apiToken {
+	token, _ := r.Context().Value(tokenKey{}).(*apiToken)
+	return token
+}
+
+// uploadNamer is names for uploads the server names itself, moved below the
+// prefix of the request's token.
+func uploadNamer(r *http.Request, names *namer) *namer {
+	if token := requestToken(r); token != nil && token.Prefix != "" {
+		return names.under(token.Prefix)
+	}
+	return names
+}
+
+// routeAccess returns the scopes a request needs and the stored names it
+// addresses directly. No scopes means the route is public.
+func routeAccess(r *http.Request) ([]string, []string) {
+	p := r.URL.Path
+	switch {
+	case p == "/" || p == "/health" || p == "/metrics":
+		return nil, nil
+	case p == "/upload" && r.URL.Query().Has("sig"):
+		// Signed upload links are checked by uploadHandler
+		return nil, nil
+	case strings.HasPrefix(p, "/s/"):
+		// Download shares carry their own ID and optional password
+		return nil, nil
+	case strings.HasPrefix(p, "/box/"):
+		// The drop box ID is its upload token
+		return nil, nil
+	case strings.HasPrefix(p, "/admin/"):
+		return []string{scopeAdmin}, nil
+	case p == "/upload", strings.HasPrefix(p, "/tus/"), p == "/chunks", strings.HasPrefix(p, "/chunks/"):
+		return []string{scopeUpload}, nil
+	case p == "/files":
+		return []string{scopeList}, nil
+	case p == "/files/delete":
+		return []string{scopeDelete}, nil
+	case strings.HasPrefix(p, "/files/"):
+		name := strings.TrimPrefix(p, "/files/")
+		switch r.Method {
+		case http.MethodPut:
+			return []string{scopeUpload}, []string{name}
+		case http.MethodDelete:
+			return []string{scopeDelete}, []string{name}
+		default:
+			return []string{scopeDownload}, []string{name}
+		}
+	case p == "/dav" || strings.HasPrefix(p, "/dav/"):
+		names := []string{davName(p)}
+		switch r.Method {
+		case "PROPFIND", http.MethodOptions:
+			return []string{scopeList}, names
+		case http.MethodGet, http.MethodHead:
+			return []string{scopeDownload}, names
+		case http.MethodDelete:
+			return []string{scopeDelete}, names
+		case "MOVE":
+			if dest, err := url.Parse(r.Header.Get("Destination")); err == nil {
+				names = append(names, davName(dest.Path))
+			}
+			return []string{scopeUpload, scopeDelete}, names
+		default:
+			return []string{scopeUpload}, names
+		}
+	default:
+		return nil, nil
+	}
+}
+
+// middleware rejects requests without a token carrying the scopes the route
+// needs, before any body is read, and makes the token available to handlers
+// through requestToken.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	if !a.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes, names := routeAccess(r)
+		if len(scopes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := a.lookup(r)
+		if !ok {
+			challenge := `Bearer realm="file-upload-web"`
+			if strings.HasPrefix(r.URL.Path, "/dav") {
+				// Lets WebDAV clients and file managers ask for the token
+				challenge = `Basic realm="file-upload-web"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid token")
+			return
+		}
+		for _, scope := range scopes {
+			if !token.has(scope) {
+				writeError(w, r, http.StatusForbidden, codeForbidden, fmt.Sprintf("Token lacks the %s scope", scope))
+				return
+			}
+		}
+		for _, name := range names {
+			if !token.allows(name) {
+				writeError(w, r, http.StatusForbidden, codeForbidden, fmt.Sprintf("Token is limited to %s/", token.Prefix))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	})
+}
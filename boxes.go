@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBoxExpiry is how long a drop box accepts uploads unless its
+// creator asks otherwise.
+const defaultBoxExpiry = 30 * 24 * time.Hour
+
+// dropBox is the persisted state of an upload box, e.g. one per support
+// ticket. Everything uploaded to /box/{id} is stored below Folder; the
+// random ID is the box's upload token.
+type dropBox struct {
+	ID        string     `json:"id"`
+	Reference string     `json:"reference"`
+	Folder    string     `json:"folder"`
+	Created   time.Time  `json:"created"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	Expires   time.Time  `json:"expires"`
+	MaxSize   int64      `json:"max_size,omitempty"`
+	MaxFiles  int        `json:"max_files,omitempty"`
+	MaxBytes  int64      `json:"max_bytes,omitempty"`
+	Files     int        `json:"files"`
+	Bytes     int64      `json:"bytes"`
+	Closed    *time.Time `json:"closed,omitempty"`
+}
+
+// status explains why b no longer accepts uploads, or is empty while it
+// does.
+func (b *dropBox) status() string {
+	switch {
+	case b.Closed != nil:
+		return "Drop box has been closed"
+	case time.Now().After(b.Expires):
+		return "Drop box has expired"
+	}
+	return ""
+}
+
+// remaining is how many more files b takes, or 0 for no limit.
+func (b *dropBox) remaining() int {
+	if b.MaxFiles == 0 {
+		return 0
+	}
+	return max(b.MaxFiles-b.Files, 0)
+}
+
+// remainingBytes is how many more bytes b takes in total, or 0 for no
+// limit.
+func (b *dropBox) remainingBytes() int64 {
+	if b.MaxBytes == 0 {
+		return 0
+	}
+	return max(b.MaxBytes-b.Bytes, 0)
+}
+
+// boxRequest is the body of POST /admin/boxes.
+type boxRequest struct {
+	Reference string `json:"reference"`
+	Folder    string `json:"folder"`
+	ExpiresIn string `json:"expires_in"`
+	MaxSize   int64  `json:"max_size"`
+	MaxFiles  int    `json:"max_files"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// boxInfo describes a box in admin responses.
+type boxInfo struct {
+	dropBox
+	URL    string `json:"url"`
+	Active bool   `json:"active"`
+}
+
+// boxLanding is what the landing page learns about a box from GET
+// /box/{id}; it leaves out the folder and counts of other uploads.
+type boxLanding struct {
+	Reference string    `json:"reference"`
+	Expires   time.Time `json:"expires"`
+	MaxSize   int64     `json:"max_size"`
+	Remaining *int      `json:"remaining_files,omitempty"`
+}
+
+// boxHandler serves drop box uploads under /box/ and their management
+// under /admin/boxes. Boxes are kept as one JSON record per ID in dir,
+// also after they close, so their folders are never handed out twice.
+type boxHandler struct {
+	dir          string
+	store        Storage
+	names        *namer
+	types        *typePolicy
+	maxSizeBytes int64
+	publicURL    string
+
+	// mu serializes creating boxes and updating their records
+	mu sync.Mutex
+	// locks holds a *sync.Mutex per box so uploads can't exceed its limits
+	locks sync.Map
+}
+
+func newBoxHandler(dir string, store Storage, names *namer, types *typePolicy, maxSizeBytes int64, publicURL string) (*boxHandler, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &boxHandler{dir: dir, store: store, names: names, types: types, maxSizeBytes: maxSizeBytes, publicURL: publicURL}, nil
+}
+
+// ServeHTTP handles /box/{id}: GET shows the landing page, or the box's
+// reference and limits as JSON, and POST uploads like POST /upload.
+func (h *boxHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/box/")
+	b, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	if msg := b.status(); msg != "" {
+		writeError(w, r, http.StatusGone, codeNotFound, msg)
+		return
+	}
+	if r.Method == http.MethodPost {
+		h.upload(w, r, id)
+		return
+	}
+
+	if !wantsJSON(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(indexHTML))
+		return
+	}
+	landing := boxLanding{Reference: b.Reference, Expires: b.Expires, MaxSize: h.maxSizeBytes}
+	if b.MaxSize > 0 {
+		landing.MaxSize = min(landing.MaxSize, b.MaxSize)
+	}
+	if b.MaxBytes > 0 {
+		landing.MaxSize = min(landing.MaxSize, b.remainingBytes())
+	}
+	if b.MaxFiles > 0 {
+		remaining := b.remaining()
+		landing.Remaining = &remaining
+	}
+	writeJSON(w, http.StatusOK, landing)
+}
+
+// upload stores the files of a POST to box id below its folder. Uploads
+// to one box are serialized so its file and byte limits hold.
+func (h *boxHandler) upload(w http.ResponseWriter, r *http.Request, id string) {
+	lock, _ := h.locks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	b, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	if msg := b.status(); msg != "" {
+		writeError(w, r, http.StatusGone, codeNotFound, msg)
+		return
+	}
+	maxSizeBytes := h.maxSizeBytes
+	if b.MaxSize > 0 {
+		maxSizeBytes = min(maxSizeBytes, b.MaxSize)
+	}
+	remaining := b.remaining()
+	if b.MaxFiles > 0 && remaining == 0 {
+		writeError(w, r, http.StatusConflict, codeConflict, "Drop box is full")
+		return
+	}
+	remainingBytes := b.remainingBytes()
+	if b.MaxBytes > 0 {
+		if remainingBytes == 0 {
+			writeError(w, r, http.StatusRequestEntityTooLarge, codeFileTooLarge, "Drop box has no space left")
+			return
+		}
+		maxSizeBytes = min(maxSizeBytes, remainingBytes)
+	}
+
+	names := h.names.under(b.Folder)
+	var results []uploadResult
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		results = handleMultipartUpload(w, r, h.store, names, h.types, maxSizeBytes, remaining, remainingBytes)
+	} else {
+		results = handleRawUpload(w, r, h.store, names, h.types, maxSizeBytes)
+	}
+
+	var files int
+	var bytes int64
+	for _, result := range results {
+		if result.Error == nil {
+			files++
+			bytes += result.Size
+			log.Printf("File uploaded to drop box %s: %s", b.Reference, result.StoredName)
+		}
+	}
+	if files == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	latest, err := h.read(id)
+	if err == nil {
+		latest.Files += files
+		latest.Bytes += bytes
+		err = h.save(latest)
+	}
+	if err != nil {
+		log.Printf("Failed to update drop box %s: %v", id, err)
+	}
+}
+
+// admin handles /admin/boxes: POST creates a box, GET lists them, and GET
+// or DELETE /admin/boxes/{id} shows or closes one. Closing keeps the files.
+func (h *boxHandler) admin(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/boxes"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		h.create(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		h.list(w, r)
+	case id != "" && (r.Method == http.MethodGet || r.Method == http.MethodDelete):
+		b, ok := h.load(w, r, id)
+		if !ok || !h.owns(w, r, b) {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			b, ok = h.close(w, r, id)
+			if !ok {
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, h.info(r, b))
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (h *boxHandler) create(w http.ResponseWriter, r *http.Request) {
+	req := boxRequest{ExpiresIn: defaultBoxExpiry.String()}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid JSON body")
+		return
+	}
+	req.Reference = strings.TrimSpace(req.Reference)
+	if req.Reference == "" || len(req.Reference) > 200 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "A reference of at most 200 characters is required")
+		return
+	}
+	expiresIn, err := time.ParseDuration(req.ExpiresIn)
+	if err != nil || expiresIn <= 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid expires_in (e.g. 720h)")
+		return
+	}
+	if req.MaxSize < 0 || req.MaxFiles < 0 || req.MaxBytes < 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "max_size, max_files and max_bytes must not be negative")
+		return
+	}
+	folder := strings.Trim(req.Folder, "/")
+	if folder == "" {
+		folder = sanitizeFilenameWithMaxLen(req.Reference, 100)
+	}
+	if !validStoredName(folder) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidFilename, "Invalid folder")
+		return
+	}
+	b := &dropBox{
+		ID:        randomHex(16),
+		Reference: req.Reference,
+		Folder:    folder,
+		Created:   time.Now().UTC().Truncate(time.Second),
+		Expires:   time.Now().UTC().Add(expiresIn).Truncate(time.Second),
+		MaxSize:   req.MaxSize,
+		MaxFiles:  req.MaxFiles,
+		MaxBytes:  req.MaxBytes,
+	}
+	if token := requestToken(r); token != nil {
+		b.CreatedBy = token.Name
+	}
+	if !h.owns(w, r, b) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	boxes, err := h.all()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to list drop boxes")
+		log.Printf("Failed to list drop boxes: %v", err)
+		return
+	}
+	// Folders nest, so one box's folder can't contain another's either
+	if slices.ContainsFunc(boxes, func(other *dropBox) bool {
+		return other.Folder == folder || strings.HasPrefix(other.Folder, folder+"/") || strings.HasPrefix(folder, other.Folder+"/")
+	}) {
+		writeError(w, r, http.StatusConflict, codeConflict, "Folder is already used by another drop box")
+		return
+	}
+	if err := h.save(b); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to save drop box")
+		log.Printf("Failed to save drop box %s: %v", b.ID, err)
+		return
+	}
+	log.Printf("Drop box created: %s in %s/", b.Reference, b.Folder)
+	writeJSON(w, http.StatusCreated, h.info(r, b))
+}
+
+// list returns the boxes the token may see, optionally only active ones,
+// newest first.
+func (h *boxHandler) list(w http.ResponseWriter, r *http.Request) {
+	boxes, err := h.all()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to list drop boxes")
+		log.Printf("Failed to list drop boxes: %v", err)
+		return
+	}
+	activeOnly := r.URL.Query().Get("active") == "true"
+	token := requestToken(r)
+	infos := []boxInfo{}
+	for _, b := range boxes {
+		if token.allows(b.Folder) && (!activeOnly || b.status() == "") {
+			infos = append(infos, h.info(r, b))
+		}
+	}
+	slices.SortFunc(infos, func(a, b boxInfo) int { return b.Created.Compare(a.Created) })
+	writeJSON(w, http.StatusOK, map[string]any{"boxes": infos})
+}
+
+func (h *boxHandler) close(w http.ResponseWriter, r *http.Request, id string) (*dropBox, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.load(w, r, id)
+	if !ok {
+		return nil, false
+	}
+	if b.Closed == nil {
+		now := time.Now().UTC().Truncate(time.Second)
+		b.Closed = &now
+		if err := h.save(b); err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to close drop box")
+			log.Printf("Failed to save drop box %s: %v", id, err)
+			return nil, false
+		}
+		log.Printf("Drop box closed: %s", b.Reference)
+	}
+	return b, true
+}
+
+// owns checks that a prefix-limited token may manage a box in the folder.
+func (h *boxHandler) owns(w http.ResponseWriter, r *http.Request, b *dropBox) bool {
+	if token := requestToken(r); !token.allows(b.Folder) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "Token is limited to "+token.Prefix+"/")
+		return false
+	}
+	return true
+}
+
+func (h *boxHandler) info(r *http.Request, b *dropBox) boxInfo {
+	return boxInfo{dropBox: *b, URL: strings.TrimSuffix(baseURL(r, h.publicURL), "/") + "/box/" + b.ID, Active: b.status() == ""}
+}
+
+// load reads a box, writing 404 if it doesn't exist.
+func (h *boxHandler) load(w http.ResponseWriter, r *http.Request, id string) (*dropBox, bool) {
+	b, err := h.read(id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Drop box not found")
+		} else {
+			writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to read drop box")
+			log.Printf("Failed to read drop box %s: %v", id, err)
+		}
+		return nil, false
+	}
+	return b, true
+}
+
+// all reads every box record.
+func (h *boxHandler) all() ([]*dropBox, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var boxes []*dropBox
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		b, err := h.read(id)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, b)
+	}
+	return boxes, nil
+}
+
+func (h *boxHandler) read(id string) (*dropBox, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return nil, fs.ErrNotExist
+	}
+	data, err := os.ReadFile(h.path(id))
+	if err != nil {
+		return nil, err
+	}
+	var b dropBox
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// save writes the box record atomically.
+func (h *boxHandler) save(b *dropBox) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	tmp := h.path(b.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path(b.ID))
+}
+
+func (h *boxHandler) path(id string) string {
+	return filepath.Join(h.dir, id+".json")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Checksum algorithms, named as in the HTTP digest registry. SHA-256 is
+// always computed; the others only when the client supplies or asks for
+// them.
+const (
+	algSHA256 = "sha-256"
+	algMD5    = "md5"
+	algCRC32C = "crc32c"
+)
+
+// errChecksumMismatch is returned at the end of the body when it doesn't
+// match a digest the client supplied.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksums maps an algorithm to a digest.
+type checksums map[string][]byte
+
+func newHash(alg string) hash.Hash {
+	switch alg {
+	case algMD5:
+		return md5.New()
+	case algCRC32C:
+		return crc32.New(crc32cTable)
+	default:
+		return sha256.New()
+	}
+}
+
+// checksumReader hashes everything read through it. At EOF it compares the
+// result with the expected digests and fails with errChecksumMismatch
+// instead of io.EOF, so the storage backend discards the file rather than
+// committing it. It also keeps the first bytes for content sniffing, and
+// fails the same way if check rejects the sniffed type.
+type checksumReader struct {
+	r        io.Reader
+	w        io.Writer
+	hashes   map[string]hash.Hash
+	expected checksums
+	head     []byte
+	check    func(detected string) error
+	checked  bool
+	// started is set by the first Read; the source can't be sent again
+	started bool
+}
+
+// sniffLen is how much http.DetectContentType looks at.
+const sniffLen = 512
+
+// newChecksumReader computes SHA-256, every algorithm in expected, and any
+// extra algorithms requested.
+func newChecksumReader(r io.Reader, expected checksums, extra []string) *checksumReader {
+	c := &checksumReader{r: r, hashes: map[string]hash.Hash{algSHA256: sha256.New()}, expected: expected}
+	for alg := range expected {
+		c.hashes[alg] = newHash(alg)
+	}
+	for _, alg := range extra {
+		if c.hashes[alg] == nil {
+			c.hashes[alg] = newHash(alg)
+		}
+	}
+
+	writers := make([]io.Writer, 0, len(c.hashes))
+	for _, h := range c.hashes {
+		writers = append(writers, h)
+	}
+	c.w = io.MultiWriter(writers...)
+	return c
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	c.started = true
+	n, err := c.r.Read(p)
+	c.w.Write(p[:n])
+	if len(c.head) < sniffLen {
+		c.head = append(c.head, p[:min(n, sniffLen-len(c.head))]...)
+	}
+	if c.check != nil && !c.checked && (len(c.head) == sniffLen || err == io.EOF) {
+		c.checked = true
+		if err := c.check(c.detectedType()); err != nil {
+			return n, err
+		}
+	}
+	if err == io.EOF {
+		for alg, want := range c.expected {
+			if !bytes.Equal(c.hashes[alg].Sum(nil), want) {
+				return n, fmt.Errorf("%w (%s)", errChecksumMismatch, alg)
+			}
+		}
+	}
+	return n, err
+}
+
+// sum returns the hex digest for alg, or "" if it wasn't computed.
+func (c *checksumReader) sum(alg string) string {
+	if h := c.hashes[alg]; h != nil {
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	return ""
+}
+
+// detectedType sniffs the MIME type from the start of the content.
+func (c *checksumReader) detectedType() string {
+	if len(c.head) == 0 {
+		return ""
+	}
+	return detectType(c.head)
+}
+
+// headerChecksums collects the digests a client sent for the body in
+// Content-MD5, Digest (RFC 3230), Repr-Digest or Content-Digest (RFC 9530).
+func headerChecksums(h http.Header) (checksums, error) {
+	expected := checksums{}
+	if v := h.Get("Content-MD5"); v != "" {
+		if err := expected.add(algMD5, v); err != nil {
+			return nil, fmt.Errorf("Content-MD5: %w", err)
+		}
+	}
+	for _, name := range []string{"Digest", "Repr-Digest", "Content-Digest"} {
+		for _, field := range h.Values(name) {
+			for _, member := range strings.Split(field, ",") {
+				alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+				alg = strings.ToLower(alg)
+				if !ok || !knownChecksum(alg) {
+					continue
+				}
+				// RFC 9530 wraps the base64 value in colons
+				value = strings.Trim(value, ":")
+				if err := expected.add(alg, value); err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		}
+	}
+	return expected, nil
+}
+
+// wantedChecksums returns the optional algorithms a client asked for with
+// Want-Repr-Digest or Want-Digest.
+func wantedChecksums(h http.Header) []string {
+	var algs []string
+	for _, name := range []string{"Want-Repr-Digest", "Want-Digest"} {
+		for _, field := range h.Values(name) {
+			for _, member := range strings.Split(field, ",") {
+				alg, _, _ := strings.Cut(strings.TrimSpace(member), "=")
+				alg, _, _ = strings.Cut(alg, ";")
+				if alg = strings.ToLower(alg); knownChecksum(alg) {
+					algs = append(algs, alg)
+				}
+			}
+		}
+	}
+	return algs
+}
+
+// checksumField maps multipart form field names to algorithms.
+var checksumField = map[string]string{
+	"sha256": algSHA256,
+	"md5":    algMD5,
+	"crc32c": algCRC32C,
+}
+
+func knownChecksum(alg string) bool {
+	return alg == algSHA256 || alg == algMD5 || alg == algCRC32C
+}
+
+// add decodes value as hex or base64 and records it for alg. A digest
+// already given for alg must agree.
+func (c checksums) add(alg, value string) error {
+	size := newHash(alg).Size()
+	digest, err := hex.DecodeString(value)
+	if err != nil || len(digest) != size {
+		digest, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(digest) != size {
+		return fmt.Errorf("invalid %s digest %q", alg, value)
+	}
+	if previous, ok := c[alg]; ok && !bytes.Equal(previous, digest) {
+		return fmt.Errorf("conflicting %s digests", alg)
+	}
+	c[alg] = digest
+	return nil
+}
+
+// merge adds the digests from other, which must agree with those already
+// present.
+func (c checksums) merge(other checksums) error {
+	for alg, digest := range other {
+		if err := c.add(alg, hex.EncodeToString(digest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunk size limits. The default stays well under the 1 MB body limit
+// common on corporate proxies.
+const (
+	defaultChunkSize = 512 * 1024
+	minChunkSize     = 64 * 1024
+	maxChunkSize     = 32 * 1024 * 1024
+	maxChunkCount    = 10000
+)
+
+// chunkSession is the persisted state of a chunked upload. Each received
+// chunk is stored in the session directory as {index}.part.
+type chunkSession struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	MimeType  string    `json:"mime_type,omitempty"`
+	Size      int64     `json:"size"`
+	ChunkSize int64     `json:"chunk_size"`
+	Chunks    int       `json:"chunks"`
+	Expires   time.Time `json:"expires"`
+	Received  []int     `json:"received,omitempty"`
+}
+
+// chunkLength returns the expected length of chunk index.
+func (s *chunkSession) chunkLength(index int) int64 {
+	return min(s.ChunkSize, s.Size-int64(index)*s.ChunkSize)
+}
+
+// chunkHandler implements the init/chunk/complete upload API under
+// /chunks/. Chunks may arrive in any order and in parallel; each is
+// checked against its SHA-256 before being kept.
+type chunkHandler struct {
+	dir          string
+	store        Storage
+	names        *namer
+	types        *typePolicy
+	maxSizeBytes int64
+	expiry       time.Duration
+
+	// locks holds a *sync.RWMutex per session: chunk uploads share it,
+	// completion and abort take it exclusively
+	locks sync.Map
+}
+
+func newChunkHandler(dir string, store Storage, names *namer, types *typePolicy, maxSizeBytes int64, expiry time.Duration) (*chunkHandler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &chunkHandler{dir: dir, store: store, names: names, types: types, maxSizeBytes: maxSizeBytes, expiry: expiry}
+	h.removeExpired()
+	return h, nil
+}
+
+func (h *chunkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/chunks"), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+			return
+		}
+		h.init(w, r)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	if !uploadIDPattern.MatchString(id) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Upload not found")
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		h.status(w, r, id)
+	case action == "" && r.Method == http.MethodDelete:
+		h.abort(w, r, id)
+	case action == "complete" && r.Method == http.MethodPost:
+		h.complete(w, r, id)
+	case action != "" && action != "complete" && r.Method == http.MethodPut:
+		index, err := strconv.Atoi(action)
+		if err != nil || strconv.Itoa(index) != action {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Chunk not found")
+			return
+		}
+		if index < 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Chunk index must not be negative")
+			return
+		}
+		h.putChunk(w, r, id, index)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// init handles POST /chunks/, starting a new chunked upload.
+func (h *chunkHandler) init(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Filename  string `json:"filename"`
+		Size      int64  `json:"size"`
+		ChunkSize int64  `json:"chunk_size"`
+		MimeType  string `json:"mime_type"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid JSON body")
+		return
+	}
+	if req.Filename == "" {
+		writeError(w, r, http.StatusBadRequest, codeNoFile, "No filename provided")
+		return
+	}
+	if req.Size <= 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Size must be positive")
+		return
+	}
+	if req.Size > h.maxSizeBytes {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeFileTooLarge, "File too large")
+		return
+	}
+	if err := h.types.check("", req.MimeType, req.Filename); err != nil {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, err.Error())
+		return
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = defaultChunkSize
+	}
+	if req.ChunkSize < minChunkSize || req.ChunkSize > maxChunkSize {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Chunk size must be between %d and %d bytes", minChunkSize, maxChunkSize))
+		return
+	}
+	chunks := (req.Size + req.ChunkSize - 1) / req.ChunkSize
+	if chunks > maxChunkCount {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Too many chunks, use a chunk size of at least %d bytes", (req.Size+maxChunkCount-1)/maxChunkCount))
+		return
+	}
+
+	// Starting an upload is infrequent, so it's a convenient time to clean up
+	h.removeExpired()
+
+	session := &chunkSession{
+		ID:        randomHex(16),
+		Filename:  req.Filename,
+		MimeType:  req.MimeType,
+		Size:      req.Size,
+		ChunkSize: req.ChunkSize,
+		Chunks:    int(chunks),
+		Expires:   time.Now().Add(h.expiry),
+	}
+	if err := os.Mkdir(h.sessionDir(session.ID), 0755); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to create upload")
+		log.Printf("Failed to create chunked upload: %v", err)
+		return
+	}
+	data, _ := json.Marshal(session)
+	if err := os.WriteFile(h.sessionPath(session.ID), data, 0644); err != nil {
+		os.RemoveAll(h.sessionDir(session.ID))
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to create upload")
+		log.Printf("Failed to create chunked upload: %v", err)
+		return
+	}
+
+	log.Printf("Chunked upload created: %s (%s, %d bytes in %d chunks)", session.ID, session.Filename, session.Size, session.Chunks)
+	w.Header().Set("Location", "/chunks/"+session.ID)
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// putChunk handles PUT /chunks/{id}/{index}. The body must be exactly the
+// chunk's length and match the X-Chunk-SHA256 header. Re-sending a chunk
+// replaces it, so failed chunks can simply be retried.
+func (h *chunkHandler) putChunk(w http.ResponseWriter, r *http.Request, id string, index int) {
+	want, err := hex.DecodeString(r.Header.Get("X-Chunk-SHA256"))
+	if err != nil || len(want) != sha256.Size {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Missing or invalid X-Chunk-SHA256 header")
+		return
+	}
+
+	lock := h.lock(id)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	session, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	if index >= session.Chunks {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Chunk index must be below %d", session.Chunks))
+		return
+	}
+	length := session.chunkLength(index)
+
+	tmp, err := os.CreateTemp(h.sessionDir(id), tempPattern)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to write chunk")
+		log.Printf("Failed to create chunk file: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), http.MaxBytesReader(w, r.Body, length))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeFileTooLarge, fmt.Sprintf("Chunk %d must be %d bytes", index, length))
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to write chunk")
+		log.Printf("Failed to write chunk %d of %s: %v", index, id, err)
+		return
+	case n != length:
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Chunk %d must be %d bytes, got %d", index, length, n))
+		return
+	case !bytes.Equal(hash.Sum(nil), want):
+		writeError(w, r, http.StatusBadRequest, codeChecksumMismatch, fmt.Sprintf("Chunk %d does not match its SHA-256", index))
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), h.chunkPath(id, index)); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to write chunk")
+		log.Printf("Failed to store chunk %d of %s: %v", index, id, err)
+		return
+	}
+
+	// Every chunk counts as activity for expiry
+	now := time.Now()
+	os.Chtimes(h.sessionPath(id), now, now)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// status handles GET /chunks/{id}, listing the chunks received so far so a
+// client can resume.
+func (h *chunkHandler) status(w http.ResponseWriter, r *http.Request, id string) {
+	session, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	session.Received = h.received(session)
+	if session.Received == nil {
+		session.Received = []int{}
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// complete handles POST /chunks/{id}/complete, assembling the chunks in
+// order into storage. Checksum headers on the request are verified against
+// the whole file, and the response matches POST /upload.
+func (h *chunkHandler) complete(w http.ResponseWriter, r *http.Request, id string) {
+	expected, err := headerChecksums(r.Header)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	lock := h.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	session, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	if received := len(h.received(session)); received != session.Chunks {
+		writeError(w, r, http.StatusConflict, codeConflict, fmt.Sprintf("Missing %d of %d chunks", session.Chunks-received, session.Chunks))
+		return
+	}
+
+	src := &chunkReader{handler: h, session: session}
+	result := storeFile(h.store, uploadNamer(r, h.names), h.types, session.Filename, session.MimeType, newChecksumReader(src, expected, wantedChecksums(r.Header)), requestOrigin(r, "chunked"))
+	src.Close()
+
+	// A failed upload keeps its chunks so completion can be retried
+	if result.Error == nil {
+		h.remove(id)
+	}
+	writeUploadResults(w, r, []uploadResult{result})
+}
+
+// abort handles DELETE /chunks/{id}, discarding an unfinished upload.
+func (h *chunkHandler) abort(w http.ResponseWriter, r *http.Request, id string) {
+	lock := h.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, ok := h.load(w, r, id); !ok {
+		return
+	}
+	h.remove(id)
+	log.Printf("Chunked upload aborted: %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *chunkHandler) lock(id string) *sync.RWMutex {
+	lock, _ := h.locks.LoadOrStore(id, &sync.RWMutex{})
+	return lock.(*sync.RWMutex)
+}
+
+// load reads a session, writing 404 or 410 if it is missing or expired.
+// Expiry counts from the last chunk received.
+func (h *chunkHandler) load(w http.ResponseWriter, r *http.Request, id string) (*chunkSession, bool) {
+	session, err := h.read(id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Upload not found")
+		} else {
+			writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to read upload")
+			log.Printf("Failed to read chunked upload %s: %v", id, err)
+		}
+		return nil, false
+	}
+	if time.Now().After(session.Expires) {
+		h.remove(id)
+		writeError(w, r, http.StatusGone, codeNotFound, "Upload expired")
+		return nil, false
+	}
+	return session, true
+}
+
+func (h *chunkHandler) read(id string) (*chunkSession, error) {
+	info, err := os.Stat(h.sessionPath(id))
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(h.sessionPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var session chunkSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	session.Expires = info.ModTime().Add(h.expiry)
+	return &session, nil
+}
+
+// received returns the indexes of the chunks stored so far, in order.
+func (h *chunkHandler) received(session *chunkSession) []int {
+	var indexes []int
+	for i := 0; i < session.Chunks; i++ {
+		if info, err := os.Stat(h.chunkPath(session.ID, i)); err == nil && info.Size() == session.chunkLength(i) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func (h *chunkHandler) remove(id string) {
+	os.RemoveAll(h.sessionDir(id))
+	h.locks.Delete(id)
+}
+
+// removeExpired deletes sessions with no activity within the expiry.
+func (h *chunkHandler) removeExpired() {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		log.Printf("Failed to list chunked uploads: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		id := entry.Name()
+		if !entry.IsDir() || !uploadIDPattern.MatchString(id) {
+			continue
+		}
+		session, err := h.read(id)
+		if errors.Is(err, fs.ErrNotExist) || (err == nil && time.Now().After(session.Expires)) {
+			h.remove(id)
+			log.Printf("Chunked upload expired: %s", id)
+		}
+	}
+}
+
+func (h *chunkHandler) sessionDir(id string) string {
+	return filepath.Join(h.dir, id)
+}
+
+func (h *chunkHandler) sessionPath(id string) string {
+	return filepath.Join(h.dir, id, "session.json")
+}
+
+func (h *chunkHandler) chunkPath(id string, index int) string {
+	return filepath.Join(h.dir, id, strconv.Itoa(index)+".part")
+}
+
+// chunkReader reads a session's chunks back to back, opening each only
+// when it is reached so large uploads don't hold thousands of files open.
+type chunkReader struct {
+	handler *chunkHandler
+	session *chunkSession
+	next    int
+	current *os.File
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if c.next >= c.session.Chunks {
+				return 0, io.EOF
+			}
+			f, err := os.Open(c.handler.chunkPath(c.session.ID, c.next))
+			if err != nil {
+				return 0, err
+			}
+			c.current = f
+			c.next++
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	return c.current.Close()
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// davLockTimeout is the lifetime reported for WebDAV locks.
+const davLockTimeout = "Second-3600"
+
+// lockTokenPattern matches the tokens lock issues, so a refresh can only
+// echo back a well-formed one.
+var lockTokenPattern = regexp.MustCompile(`<(opaquelocktoken:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})>`)
+
+// davHandler serves storage over a minimal WebDAV (class 1 and 2) under
+// /dav/ so it can be mounted as a network drive. Collections are implied
+// by "/" in stored names; empty ones created with MKCOL are only kept in
+// memory and don't survive a restart. Locks are issued but not enforced,
+// which is enough for the Windows and macOS clients that refuse to write
+// without them.
+type davHandler struct {
+	store        Storage
+	names        *namer
+	types        *typePolicy
+	maxSizeBytes int64
+
+	mu          sync.Mutex
+	collections map[string]bool
+}
+
+func newDavHandler(store Storage, names *namer, types *typePolicy, maxSizeBytes int64) *davHandler {
+	return &davHandler{store: store, names: names, types: types, maxSizeBytes: maxSizeBytes, collections: map[string]bool{}}
+}
+
+// davResource is a file or collection as seen through WebDAV. The root
+// collection has an empty name.
+type davResource struct {
+	name       string
+	collection bool
+	info       FileInfo
+}
+
+func (h *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := davName(r.URL.Path)
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, MOVE, LOCK, UNLOCK")
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.WriteHeader(http.StatusOK)
+	case "PROPFIND":
+		h.propfind(w, r, name)
+	case http.MethodGet, http.MethodHead:
+		res, _, ok := h.lookup(w, r, name)
+		if !ok {
+			return
+		}
+		if res.collection {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Collections can't be downloaded")
+			return
+		}
+		serveFile(w, r, h.store, h.names, name)
+	case http.MethodPut:
+		if h.isCollection(name, nil) {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Can't PUT to a collection")
+			return
+		}
+		handlePut(w, r, h.store, h.types, h.maxSizeBytes, name, "webdav")
+	case http.MethodDelete:
+		h.delete(w, r, name)
+	case "MKCOL":
+		h.mkcol(w, r, name)
+	case "MOVE":
+		h.move(w, r, name)
+	case "LOCK":
+		h.lock(w, r, name)
+	case "UNLOCK":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// davName turns a /dav/ URL path into a stored name or collection prefix.
+func davName(urlPath string) string {
+	return strings.Trim(strings.TrimPrefix(urlPath, "/dav"), "/")
+}
+
+// davHref is the escaped URL of res, with a trailing slash for collections.
+func davHref(res davResource) string {
+	p := "/dav/" + res.name
+	if res.collection && res.name != "" {
+		p += "/"
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// lookup finds name as a file or collection, writing 404 if it is neither.
+// It also returns the full listing, which callers use to find children.
+func (h *davHandler) lookup(w http.ResponseWriter, r *http.Request, name string) (davResource, []FileInfo, bool) {
+	if name != "" && !validStoredName(name) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Not found")
+		return davResource{}, nil, false
+	}
+	if name != "" {
+		if info, err := h.store.Stat(name); err == nil {
+			return davResource{name: name, info: info}, nil, true
+		}
+	}
+
+	files, err := h.store.List()
+	if err != nil {
+		writeStorageError(w, r, err, "Failed to list files")
+		return davResource{}, nil, false
+	}
+	if !h.isCollection(name, files) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Not found")
+		return davResource{}, nil, false
+	}
+
+	res := davResource{name: name, collection: true, info: FileInfo{Name: name}}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name, name+"/") && f.ModTime.After(res.info.ModTime) {
+			res.info.ModTime = f.ModTime
+		}
+	}
+	return res, files, true
+}
+
+// isCollection reports whether name is the root, was created with MKCOL,
+// or contains files. files is listed on demand when nil.
+func (h *davHandler) isCollection(name string, files []FileInfo) bool {
+	if name == "" {
+		return true
+	}
+	h.mu.Lock()
+	created := h.collections[name]
+	h.mu.Unlock()
+	if created {
+		return true
+	}
+
+	if files == nil {
+		var err error
+		if files, err = h.store.List(); err != nil {
+			return false
+		}
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// children returns the direct members of collection name.
+func (h *davHandler) children(name string, files []FileInfo) []davResource {
+	prefix := ""
+	if name != "" {
+		prefix = name + "/"
+	}
+
+	var members []davResource
+	dirs := map[string]int{}
+	addDir := func(dir string, modTime time.Time) {
+		if i, ok := dirs[dir]; ok {
+			if modTime.After(members[i].info.ModTime) {
+				members[i].info.ModTime = modTime
+			}
+			return
+		}
+		dirs[dir] = len(members)
+		members = append(members, davResource{name: dir, collection: true, info: FileInfo{Name: dir, ModTime: modTime}})
+	}
+
+	for _, f := range files {
+		rest, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok {
+			continue
+		}
+		if dir, _, nested := strings.Cut(rest, "/"); nested {
+			addDir(prefix+dir, f.ModTime)
+			continue
+		}
+		members = append(members, davResource{name: f.Name, info: f})
+	}
+
+	h.mu.Lock()
+	for dir := range h.collections {
+		if rest, ok := strings.CutPrefix(dir, prefix); ok && !strings.Contains(rest, "/") {
+			addDir(dir, time.Time{})
+		}
+	}
+	h.mu.Unlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].name < members[j].name })
+	return members
+}
+
+// davMultistatus is the PROPFIND response body. Tag names carry the "D:"
+// prefix literally since encoding/xml can't declare namespace prefixes.
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string            `xml:"D:displayname"`
+	ResourceType  davResourceType   `xml:"D:resourcetype"`
+	ContentLength *int64            `xml:"D:getcontentlength,omitempty"`
+	ContentType   string            `xml:"D:getcontenttype,omitempty"`
+	LastModified  string            `xml:"D:getlastmodified,omitempty"`
+	ETag          string            `xml:"D:getetag,omitempty"`
+	SupportedLock *davSupportedLock `xml:"D:supportedlock,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davSupportedLock struct {
+	LockEntry struct {
+		Scope struct {
+			Exclusive struct{} `xml:"D:exclusive"`
+		} `xml:"D:lockscope"`
+		Type struct {
+			Write struct{} `xml:"D:write"`
+		} `xml:"D:locktype"`
+	} `xml:"D:lockentry"`
+}
+
+// propfind handles PROPFIND with Depth 0 or 1; infinity is treated as 1.
+// All properties are returned whatever the request body asks for.
+func (h *davHandler) propfind(w http.ResponseWriter, r *http.Request, name string) {
+	io.Copy(io.Discard, io.LimitReader(r.Body, 1<<20))
+
+	res, files, ok := h.lookup(w, r, name)
+	if !ok {
+		return
+	}
+	resources := []davResource{res}
+	if res.collection && r.Header.Get("Depth") != "0" {
+		resources = append(resources, h.children(name, files)...)
+	}
+
+	status := davMultistatus{Namespace: "DAV:"}
+	for _, res := range resources {
+		prop := davProp{
+			DisplayName:   path.Base("/" + res.name),
+			SupportedLock: &davSupportedLock{},
+		}
+		if !res.info.ModTime.IsZero() {
+			prop.LastModified = res.info.ModTime.UTC().Format(http.TimeFormat)
+		}
+		if res.collection {
+			prop.ResourceType.Collection = &struct{}{}
+		} else {
+			size := res.info.Size
+			prop.ContentLength = &size
+			prop.ContentType = mimeTypeFor(res.name)
+			prop.ETag = fileETag(res.info)
+		}
+		status.Responses = append(status.Responses, davResponse{
+			Href:     davHref(res),
+			Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+		})
+	}
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(status)
+}
+
+// delete removes a file, or a collection with everything in it.
+func (h *davHandler) delete(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		writeError(w, r, http.StatusForbidden, codeInvalidRequest, "Can't delete the root collection")
+		return
+	}
+	res, files, ok := h.lookup(w, r, name)
+	if !ok {
+		return
+	}
+
+	if !res.collection {
+		if err := removeFile(h.store, name); err != nil {
+			writeStorageError(w, r, err, "Failed to delete file")
+			return
+		}
+		log.Printf("File deleted via WebDAV: %s", name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	for _, f := range files {
+		if strings.HasPrefix(f.Name, name+"/") {
+			if err := removeFile(h.store, f.Name); err != nil {
+				writeStorageError(w, r, err, "Failed to delete file")
+				return
+			}
+		}
+	}
+	h.forgetCollections(name)
+	log.Printf("Collection deleted via WebDAV: %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mkcol handles MKCOL. Storage has no directories, so the collection is
+// remembered in memory.
+func (h *davHandler) mkcol(w http.ResponseWriter, r *http.Request, name string) {
+	if r.ContentLength > 0 {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "MKCOL bodies are not supported")
+		return
+	}
+	name, ok := sanitizeStoredName(name)
+	if !ok {
+		if name == "" {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Collection already exists")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, codeInvalidFilename, "Invalid collection name")
+		return
+	}
+
+	files, err := h.store.List()
+	if err != nil {
+		writeStorageError(w, r, err, "Failed to list files")
+		return
+	}
+	if _, err := h.store.Stat(name); err == nil || h.isCollection(name, files) {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Collection already exists")
+		return
+	}
+	if parent := path.Dir(name); parent != "." && !h.isCollection(parent, files) {
+		writeError(w, r, http.StatusConflict, codeConflict, "Parent collection does not exist")
+		return
+	}
+
+	h.mu.Lock()
+	h.collections[name] = true
+	h.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+}
+
+// move handles MOVE for files and collections. Storage has no rename, so
+// files are copied to the destination and the sources deleted only once
+// every copy succeeded; a failed move leaves the sources in place.
+func (h *davHandler) move(w http.ResponseWriter, r *http.Request, name string) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Missing or invalid Destination header")
+		return
+	}
+	if dest.Host != "" && dest.Host != r.Host {
+		writeError(w, r, http.StatusBadGateway, codeInvalidRequest, "Destination is on another server")
+		return
+	}
+	if dest.Path != "/dav" && !strings.HasPrefix(dest.Path, "/dav/") {
+		writeError(w, r, http.StatusBadGateway, codeInvalidRequest, "Destination is outside /dav/")
+		return
+	}
+	destName, ok := sanitizeStoredName(davName(dest.Path))
+	if !ok || name == "" {
+		writeError(w, r, http.StatusForbidden, codeInvalidFilename, "Invalid destination")
+		return
+	}
+	if destName == name || strings.HasPrefix(destName, name+"/") || strings.HasPrefix(name, destName+"/") {
+		writeError(w, r, http.StatusForbidden, codeInvalidRequest, "Can't move a resource into itself or its parent")
+		return
+	}
+
+	res, files, ok := h.lookup(w, r, name)
+	if !ok {
+		return
+	}
+	if files == nil {
+		if files, err = h.store.List(); err != nil {
+			writeStorageError(w, r, err, "Failed to list files")
+			return
+		}
+	}
+
+	_, statErr := h.store.Stat(destName)
+	existed := statErr == nil || h.isCollection(destName, files)
+	if existed && r.Header.Get("Overwrite") == "F" {
+		writeError(w, r, http.StatusPreconditionFailed, codeConflict, "Destination exists")
+		return
+	}
+
+	// Moves pair each source file with its destination name
+	moves := map[string]string{}
+	if res.collection {
+		for _, f := range files {
+			if rest, ok := strings.CutPrefix(f.Name, name+"/"); ok {
+				moves[f.Name] = destName + "/" + rest
+			}
+		}
+	} else {
+		moves[name] = destName
+	}
+
+	// A new name must pass the type policy like an upload would
+	for src, dst := range moves {
+		if err := h.checkType(src, dst); err != nil {
+			var typeErr *typeError
+			if errors.As(err, &typeErr) {
+				writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, err.Error())
+			} else {
+				writeStorageError(w, r, err, "Failed to read file")
+			}
+			return
+		}
+	}
+
+	targets := map[string]bool{}
+	for src, dst := range moves {
+		if err := h.copyFile(src, dst); err != nil {
+			writeStorageError(w, r, err, "Failed to move file")
+			return
+		}
+		targets[dst] = true
+	}
+
+	// The destination is replaced, not merged into
+	for _, f := range files {
+		if (f.Name == destName || strings.HasPrefix(f.Name, destName+"/")) && !targets[f.Name] {
+			if err := removeFile(h.store, f.Name); err != nil {
+				writeStorageError(w, r, err, "Failed to replace destination")
+				return
+			}
+		}
+	}
+	h.forgetCollections(destName)
+
+	for src := range moves {
+		if err := removeFile(h.store, src); err != nil {
+			writeStorageError(w, r, err, "Failed to remove moved file")
+			return
+		}
+	}
+
+	h.mu.Lock()
+	for dir := range h.collections {
+		if rest, ok := strings.CutPrefix(dir, name); ok && (rest == "" || rest[0] == '/') {
+			delete(h.collections, dir)
+			h.collections[destName+rest] = true
+		}
+	}
+	h.mu.Unlock()
+
+	log.Printf("Moved via WebDAV: %s -> %s", name, destName)
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// checkType runs the type policy on src stored as dst, sniffing its content
+// again.
+func (h *davHandler) checkType(src, dst string) error {
+	if h.types == nil {
+		return nil
+	}
+	file, err := h.store.Get(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return h.types.check(detectType(head[:n]), "", dst)
+}
+
+// copyFile copies src and its sidecar over dst.
+func (h *davHandler) copyFile(src, dst string) error {
+	file, err := h.store.Get(src)
+	if err != nil {
+		return err
+	}
+	_, err = h.store.Replace(dst, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	moveMeta(h.store, src, dst)
+	return nil
+}
+
+// forgetCollections drops name and everything below it from the MKCOL set.
+func (h *davHandler) forgetCollections(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for dir := range h.collections {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(h.collections, dir)
+		}
+	}
+}
+
+// lock answers LOCK with an exclusive write lock. Refreshes reuse the
+// token from the If header. Locks are advisory: nothing checks them.
+func (h *davHandler) lock(w http.ResponseWriter, r *http.Request, name string) {
+	io.Copy(io.Discard, io.LimitReader(r.Body, 1<<20))
+
+	token := "opaquelocktoken:" + newUUID()
+	if m := lockTokenPattern.FindStringSubmatch(r.Header.Get("If")); m != nil {
+		token = m[1]
+	}
+
+	var href, escapedToken strings.Builder
+	xml.EscapeText(&href, []byte(davHref(davResource{name: name})))
+	xml.EscapeText(&escapedToken, []byte(token))
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `%s<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`+
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>0</D:depth><D:timeout>%s</D:timeout>`+
+		`<D:locktoken><D:href>%s</D:href></D:locktoken><D:lockroot><D:href>%s</D:href></D:lockroot>`+
+		`</D:activelock></D:lockdiscovery></D:prop>`, xml.Header, davLockTimeout, escapedToken.String(), href.String())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// failingReplace is a Storage whose Replace always fails.
+type failingReplace struct {
+	Storage
+}
+
+func (s failingReplace) Replace(name string, r io.Reader) (int64, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestDavMoveOverwrite(t *testing.T) {
+	names, _ := newNamer(defaultNameTemplate)
+	read := func(store Storage, name string) string {
+		rc, err := store.Get(name)
+		if err != nil {
+			return ""
+		}
+		defer rc.Close()
+		data, _ := io.ReadAll(rc)
+		return string(data)
+	}
+	var types *typePolicy
+	move := func(store Storage, src, dst string) int {
+		r := httptest.NewRequest("MOVE", "/dav/"+src, nil)
+		r.Header.Set("Destination", "/dav/"+dst)
+		r.Header.Set("Overwrite", "T")
+		w := httptest.NewRecorder()
+		newDavHandler(store, names, types, 1<<20).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("destination is replaced", func(t *testing.T) {
+		store, _ := newFileStorage(t.TempDir())
+		store.Put("new.txt", strings.NewReader("new"))
+		store.Put("old.txt", strings.NewReader("old"))
+		if code := move(store, "new.txt", "old.txt"); code != http.StatusNoContent {
+			t.Fatalf("Expected 204, got %d", code)
+		}
+		if got := read(store, "old.txt"); got != "new" {
+			t.Errorf("Expected the destination to be replaced, got %q", got)
+		}
+		if _, err := store.Stat("new.txt"); err == nil {
+			t.Errorf("Expected the source to be gone")
+		}
+	})
+
+	t.Run("failed copy keeps both files", func(t *testing.T) {
+		base, _ := newFileStorage(t.TempDir())
+		base.Put("new.txt", strings.NewReader("new"))
+		base.Put("old.txt", strings.NewReader("old"))
+		if code := move(failingReplace{base}, "new.txt", "old.txt"); code != http.StatusInternalServerError {
+			t.Fatalf("Expected 500, got %d", code)
+		}
+		if read(base, "new.txt") != "new" || read(base, "old.txt") != "old" {
+			t.Errorf("Expected source and destination to be untouched")
+		}
+	})
+	t.Run("destination name must pass the type policy", func(t *testing.T) {
+		types = newTypePolicy("", ".exe, application/x-executable")
+		defer func() { types = nil }()
+		store, _ := newFileStorage(t.TempDir())
+		store.Put("a.txt", strings.NewReader("harmless"))
+		store.Put("tool/run.txt", strings.NewReader("\x7fELF\x02\x01\x01"))
+		for src, dst := range map[string]string{"a.txt": "a.exe", "tool": "bin"} {
+			if code := move(store, src, dst); code != http.StatusUnsupportedMediaType {
+				t.Errorf("Expected 415 moving %s to %s, got %d", src, dst, code)
+			}
+		}
+		if files, _ := store.List(); len(files) != 2 || files[0].Name != "a.txt" {
+			t.Errorf("Expected nothing moved, got %v", files)
+		}
+		if code := move(store, "a.txt", "b.txt"); code != http.StatusCreated {
+			t.Errorf("Expected an allowed name to move, got %d", code)
+		}
+	})
+}
+
+func TestDavLockRefresh(t *testing.T) {
+	store, _ := newFileStorage(t.TempDir())
+	names, _ := newNamer(defaultNameTemplate)
+	h := newDavHandler(store, names, nil, 1<<20)
+	lock := func(ifHeader string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("LOCK", "/dav/a.txt", nil)
+		r.Header.Set("If", ifHeader)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	token := "opaquelocktoken:0f8fad5b-d9cb-469f-a165-70867728950e"
+	if w := lock("(<" + token + ">)"); w.Header().Get("Lock-Token") != "<"+token+">" || !strings.Contains(w.Body.String(), token) {
+		t.Errorf("Expected the refreshed token to be kept, got %q", w.Header().Get("Lock-Token"))
+	}
+
+	w := lock(`(<opaquelocktoken:x</D:href><D:owner>evil</D:owner><D:href>>)`)
+	if strings.Contains(w.Body.String(), "evil") || strings.Contains(w.Header().Get("Lock-Token"), "evil") {
+		t.Errorf("Expected a malformed token to be replaced, got %s", w.Body)
+	}
+}
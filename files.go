@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// fileEntry is the JSON representation of a stored file, following the
+// "Stored File" structure in data-model.md. The original filename as sent,
+// checksums and origin are only known for files with a metadata sidecar.
+type fileEntry struct {
+	StoredName       string        `json:"stored_name"`
+	Filename         string        `json:"filename"`
+	OriginalFilename string        `json:"original_filename,omitempty"`
+	Size             int64         `json:"size"`
+	Timestamp        time.Time     `json:"timestamp"`
+	MimeType         string        `json:"mime_type"`
+	DetectedMimeType string        `json:"detected_mime_type,omitempty"`
+	SHA256           string        `json:"sha256,omitempty"`
+	MD5              string        `json:"md5,omitempty"`
+	CRC32C           string        `json:"crc32c,omitempty"`
+	Origin           *uploadOrigin `json:"origin,omitempty"`
+}
+
+// fileList is the response body of GET /files.
+type fileList struct {
+	Files  []fileEntry `json:"files"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+// newFileEntry derives the listing entry for a stored file from its name.
+// Files that don't follow the name template keep their full name and fall
+// back to the modification time.
+func newFileEntry(info FileInfo, names *namer) fileEntry {
+	entry := fileEntry{
+		StoredName: info.Name,
+		Filename:   info.Name,
+		Size:       info.Size,
+		Timestamp:  info.ModTime,
+		MimeType:   mimeTypeFor(info.Name),
+	}
+	if ts, original, ok := names.Parse(info.Name); ok {
+		entry.Filename = original
+		if !ts.IsZero() {
+			entry.Timestamp = ts
+		}
+	}
+	return entry
+}
+
+// withMeta fills in what the metadata sidecar recorded at upload time.
+func (e fileEntry) withMeta(meta fileMeta) fileEntry {
+	e.OriginalFilename = meta.OriginalFilename
+	e.MimeType = meta.MimeType
+	e.DetectedMimeType = meta.DetectedMimeType
+	e.SHA256 = meta.SHA256
+	e.MD5 = meta.MD5
+	e.CRC32C = meta.CRC32C
+	e.Origin = &meta.uploadOrigin
+	return e
+}
+
+// mimeTypeFor guesses the MIME type from the file extension.
+func mimeTypeFor(name string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// listHandler serves GET /files from the metadata index, with pagination
+// (offset, limit), sorting (sort=time|size|name, order=asc|desc) and
+// filters on stored-name prefix, upload time (after, before), size
+// (min_size, max_size), MIME type, tag and uploader.
+func listHandler(index *metaIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		query := r.URL.Query()
+		offset, err := queryInt(query.Get("offset"), 0)
+		if err != nil || offset < 0 {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid offset")
+			return
+		}
+		limit, err := queryInt(query.Get("limit"), defaultListLimit)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid limit (1-1000)")
+			return
+		}
+		less, ok := entryOrder(query.Get("sort"), query.Get("order"))
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid sort (time, size, name) or order (asc, desc)")
+			return
+		}
+		filter, err := parseFileFilter(query)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		entries, err := index.query(filter)
+		if err != nil {
+			writeStorageError(w, r, err, "Failed to list files")
+			return
+		}
+		token := requestToken(r)
+		entries = slices.DeleteFunc(entries, func(e fileEntry) bool { return !token.allows(e.StoredName) })
+		sort.SliceStable(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+
+		result := fileList{Files: []fileEntry{}, Total: len(entries), Offset: offset, Limit: limit}
+		if offset < len(entries) {
+			result.Files = entries[offset:min(offset+limit, len(entries))]
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// parseFileFilter reads the listing filters from the query string.
+func parseFileFilter(query url.Values) (fileFilter, error) {
+	filter := fileFilter{
+		Prefix:   query.Get("prefix"),
+		MimeType: query.Get("type"),
+		Tag:      query.Get("tag"),
+		Uploader: query.Get("uploader"),
+	}
+	var err error
+	for key, t := range map[string]*time.Time{"after": &filter.After, "before": &filter.Before} {
+		if value := query.Get(key); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return filter, fmt.Errorf("Invalid %s (RFC 3339 time)", key)
+			}
+		}
+	}
+	for key, n := range map[string]*int64{"min_size": &filter.MinSize, "max_size": &filter.MaxSize} {
+		if value := query.Get(key); value != "" {
+			if *n, err = strconv.ParseInt(value, 10, 64); err != nil || *n < 0 {
+				return filter, fmt.Errorf("Invalid %s (bytes)", key)
+			}
+		}
+	}
+	return filter, nil
+}
+
+// fileHandler serves /files/{name}: GET and HEAD download the file,
+// DELETE removes it.
+func fileHandler(store Storage, names *namer, types *typePolicy, maxSizeBytes int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// PUT names the file itself, so it is sanitized rather than rejected
+		if r.Method == http.MethodPut {
+			handlePut(w, r, store, types, maxSizeBytes, strings.TrimPrefix(r.URL.Path, "/files/"), "put")
+			return
+		}
+
+		name, ok := storedNameFromPath(r.URL.Path)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, codeInvalidFilename, "Invalid filename")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			serveFile(w, r, store, names, name)
+		case http.MethodDelete:
+			if err := removeFile(store, name); err != nil {
+				writeStorageError(w, r, err, "Failed to delete file")
+				return
+			}
+			log.Printf("File deleted: %s", name)
+			if wantsJSON(r) {
+				writeJSON(w, http.StatusOK, deleteResult{Name: name, Status: "deleted"})
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "File deleted: %s", name)
+		default:
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// serveFile streams a stored file with Range, ETag and conditional request
+// support via http.ServeContent. The MIME type and SHA-256 come from the
+// metadata sidecar when there is one. Files are always attachments and
+// never sniffed, so uploaded HTML or SVG can't run in the server's origin.
+func serveFile(w http.ResponseWriter, r *http.Request, store Storage, names *namer, name string) {
+	info, err := store.Stat(name)
+	if err != nil {
+		writeStorageError(w, r, err, "Failed to read file")
+		return
+	}
+	file, err := store.Get(name)
+	if err != nil {
+		writeStorageError(w, r, err, "Failed to read file")
+		return
+	}
+	defer file.Close()
+
+	entry := newFileEntry(info, names)
+	if meta, ok := readMeta(store, info); ok {
+		entry = entry.withMeta(meta)
+	}
+	if digest, err := hex.DecodeString(entry.SHA256); err == nil && len(digest) > 0 {
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest)+":")
+	}
+	w.Header().Set("Content-Type", entry.MimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": entry.Filename}))
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, name, info.ModTime, file)
+}
+
+// fileETag identifies a version of a stored file by its modification time
+// and size.
+func fileETag(info FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size)
+}
+
+// storedNameFromPath extracts and validates the stored name from
+// /files/{name}.
+func storedNameFromPath(path string) (string, bool) {
+	name := strings.TrimPrefix(path, "/files/")
+	return name, validStoredName(name)
+}
+
+// sanitizeStoredName sanitizes each "/"-separated segment of a
+// client-chosen name. Empty and hidden segments can't be fixed up and are
+// rejected.
+func sanitizeStoredName(name string) (string, bool) {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			return "", false
+		}
+		segments[i] = sanitizeFilenameWithMaxLen(segment, 255)
+	}
+	name = strings.Join(segments, "/")
+	return name, validStoredName(name)
+}
+
+// validStoredName accepts only names whose "/"-separated segments
+// sanitizeFilenameWithMaxLen would leave unchanged, so no backslashes or
+// ".." can reach the storage backend. Hidden files are never exposed.
+func validStoredName(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || strings.HasPrefix(segment, ".") || segment != sanitizeFilenameWithMaxLen(segment, 255) {
+			return false
+		}
+	}
+	return true
+}
+
+// bulkDeleteRequest selects files for POST /files/delete, either by explicit
+// names or by a glob pattern and/or upload time range.
+type bulkDeleteRequest struct {
+	Names   []string   `json:"names"`
+	Pattern string     `json:"pattern"`
+	Before  *time.Time `json:"before"`
+	After   *time.Time `json:"after"`
+}
+
+// deleteResult reports the outcome for a single file.
+type deleteResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// bulkDeleteHandler serves POST /files/delete and returns a result per file.
+func bulkDeleteHandler(store Storage, names *namer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var req bulkDeleteRequest
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid JSON body")
+			return
+		}
+		if len(req.Names) == 0 && req.Pattern == "" && req.Before == nil && req.After == nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Specify names, pattern, before or after")
+			return
+		}
+		if len(req.Names) > 0 && (req.Pattern != "" || req.Before != nil || req.After != nil) {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Names cannot be combined with pattern or time range")
+			return
+		}
+		if _, err := path.Match(req.Pattern, ""); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid pattern")
+			return
+		}
+
+		token := requestToken(r)
+		selected := req.Names
+		if len(selected) == 0 {
+			var err error
+			selected, err = matchFiles(store, names, req)
+			if err != nil {
+				writeStorageError(w, r, err, "Failed to list files")
+				return
+			}
+			selected = slices.DeleteFunc(selected, func(name string) bool { return !token.allows(name) })
+		}
+
+		results := make([]deleteResult, 0, len(selected))
+		for _, name := range selected {
+			if !token.allows(name) {
+				results = append(results, deleteResult{Name: name, Status: "forbidden"})
+				continue
+			}
+			results = append(results, deleteFile(store, name))
+		}
+
+		writeJSON(w, http.StatusOK, map[string][]deleteResult{"results": results})
+	}
+}
+
+// matchFiles returns the stored names selected by a pattern and time range.
+func matchFiles(store Storage, names *namer, req bulkDeleteRequest) ([]string, error) {
+	infos, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []string
+	for _, info := range infos {
+		entry := newFileEntry(info, names)
+		if req.Pattern != "" {
+			if ok, _ := path.Match(req.Pattern, entry.StoredName); !ok {
+				continue
+			}
+		}
+		if req.Before != nil && !entry.Timestamp.Before(*req.Before) {
+			continue
+		}
+		if req.After != nil && !entry.Timestamp.After(*req.After) {
+			continue
+		}
+		matched = append(matched, entry.StoredName)
+	}
+	return matched, nil
+}
+
+func deleteFile(store Storage, name string) deleteResult {
+	if !validStoredName(name) {
+		return deleteResult{Name: name, Status: "invalid", Error: "invalid filename"}
+	}
+	if err := removeFile(store, name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return deleteResult{Name: name, Status: "not_found"}
+		}
+		log.Printf("Failed to delete file %s: %v", name, err)
+		return deleteResult{Name: name, Status: "error", Error: "failed to delete file"}
+	}
+	log.Printf("File deleted: %s", name)
+	return deleteResult{Name: name, Status: "deleted"}
+}
+
+// writeStorageError maps storage errors to HTTP responses.
+func writeStorageError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "File not found")
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, codeStorageError, msg)
+	log.Printf("%s: %v", msg, err)
+}
+
+// entryOrder returns the comparison for the requested sort key and order.
+// Newest first is the default.
+func entryOrder(key, order string) (func(a, b fileEntry) bool, bool) {
+	var less func(a, b fileEntry) bool
+	switch key {
+	case "", "time":
+		less = func(a, b fileEntry) bool { return a.Timestamp.Before(b.Timestamp) }
+		if order == "" {
+			order = "desc"
+		}
+	case "size":
+		less = func(a, b fileEntry) bool { return a.Size < b.Size }
+	case "name":
+		less = func(a, b fileEntry) bool { return a.Filename < b.Filename }
+	default:
+		return nil, false
+	}
+
+	switch order {
+	case "", "asc":
+		return less, true
+	case "desc":
+		return func(a, b fileEntry) bool { return less(b, a) }, true
+	default:
+		return nil, false
+	}
+}
+
+// queryInt parses an integer query parameter, returning def when empty.
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// magicType is a magic number at offset, optionally confirmed by valid.
+type magicType struct {
+	offset   int
+	magic    []byte
+	mimeType string
+	valid    func(head []byte) bool
+}
+
+// magicTypes recognizes executables and archives that http.DetectContentType
+// reports as application/octet-stream. Short magic numbers that plain text
+// can start with also need valid to confirm the format.
+var magicTypes = []magicType{
+	{0, []byte("\x7fELF"), "application/x-executable", nil},
+	{0, []byte("MZ"), "application/vnd.microsoft.portable-executable", isPortableExecutable},
+	{0, []byte("\xfe\xed\xfa\xce"), "application/x-mach-binary", nil},
+	{0, []byte("\xfe\xed\xfa\xcf"), "application/x-mach-binary", nil},
+	{0, []byte("\xce\xfa\xed\xfe"), "application/x-mach-binary", nil},
+	{0, []byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary", nil},
+	{0, []byte("#!"), "text/x-shellscript", isShebang},
+	{0, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), "application/x-ole-storage", nil},
+	{0, []byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed", nil},
+	{0, []byte("\xfd7zXZ\x00"), "application/x-xz", nil},
+	{0, []byte("BZh"), "application/x-bzip2", isBzip2},
+	{0, []byte("\x28\xb5\x2f\xfd"), "application/zstd", nil},
+	{257, []byte("ustar"), "application/x-tar", nil},
+}
+
+// detectType sniffs the MIME type of content from its first bytes,
+// without parameters.
+func detectType(head []byte) string {
+	for _, m := range magicTypes {
+		if bytes.HasPrefix(head[min(m.offset, len(head)):], m.magic) && (m.valid == nil || m.valid(head)) {
+			return m.mimeType
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return mediaType
+}
+
+// isPortableExecutable checks that the DOS header points at a "PE\0\0"
+// signature, as in Windows executables and DLLs.
+func isPortableExecutable(head []byte) bool {
+	if len(head) < 0x40 {
+		return false
+	}
+	offset := int64(binary.LittleEndian.Uint32(head[0x3c:]))
+	return offset+4 <= int64(len(head)) && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// isShebang checks for an interpreter path after "#!", e.g. "#!/bin/sh" or
+// "#! /usr/bin/env python".
+func isShebang(head []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(head[2:], " "), []byte("/"))
+}
+
+// isBzip2 checks for a block size digit followed by the magic of the first
+// block, or of the end of stream for empty input.
+func isBzip2(head []byte) bool {
+	if len(head) < 10 || head[3] < '1' || head[3] > '9' {
+		return false
+	}
+	return bytes.HasPrefix(head[4:], []byte("1AY&SY")) || bytes.HasPrefix(head[4:], []byte("\x17rE8P\x90"))
+}
+
+// genericTypes are sniffed for many specific formats, e.g. JSON and CSV
+// are text/plain and DOCX is application/zip. Each reports whether a more
+// specific declared or extension type can be stored that way, and if so
+// that type is checked instead.
+var genericTypes = map[string]func(mimeType string) bool{
+	// Unrecognized content can only be a format sniffing wouldn't recognize
+	"application/octet-stream": func(mimeType string) bool { return !sniffable(mimeType) },
+	"text/plain": func(mimeType string) bool {
+		return strings.HasPrefix(mimeType, "text/") || strings.HasSuffix(mimeType, "+json") || strings.HasSuffix(mimeType, "+xml") ||
+			slices.Contains([]string{"application/json", "application/xml", "application/javascript", "application/x-sh", "application/yaml"}, mimeType)
+	},
+	"application/zip": func(mimeType string) bool {
+		return strings.HasPrefix(mimeType, "application/vnd.openxmlformats-officedocument.") || strings.HasPrefix(mimeType, "application/vnd.oasis.opendocument.") ||
+			strings.HasSuffix(mimeType, "+zip") || mimeType == "application/java-archive"
+	},
+}
+
+// sniffableTypes are detected by http.DetectContentType or magicTypes,
+// besides the image/, audio/, video/ and font/ types it also recognizes.
+var sniffableTypes = []string{
+	"application/pdf", "application/postscript", "application/ogg", "application/wasm",
+	"application/zip", "application/gzip", "application/x-gzip", "application/vnd.rar", "application/x-rar-compressed",
+	"application/vnd.ms-fontobject",
+}
+
+// sniffable reports whether content of mimeType would be detected as such,
+// so it can't be sniffed as application/octet-stream.
+func sniffable(mimeType string) bool {
+	for _, prefix := range []string{"image/", "audio/", "video/", "font/"} {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return slices.Contains(sniffableTypes, mimeType) || slices.ContainsFunc(magicTypes, func(m magicType) bool { return m.mimeType == mimeType })
+}
+
+// agrees reports whether the sniffed type is consistent with a type the
+// file claims: equal to it, or generic and able to hold it. Generic content
+// agrees with an unknown claimed type too.
+func agrees(detected, claimed string) bool {
+	if detected == "" || detected == claimed {
+		return true
+	}
+	holds, ok := genericTypes[detected]
+	return ok && (claimed == "" || holds(claimed))
+}
+
+// typePolicy decides which file types may be uploaded. Entries are MIME
+// types, optionally with a wildcard subtype ("image/*"), or extensions
+// (".exe").
+type typePolicy struct {
+	allow []string
+	deny  []string
+}
+
+// newTypePolicy parses the comma-separated MIME_ALLOW and MIME_DENY lists.
+// It returns nil, accepting everything, when both are empty.
+func newTypePolicy(allow, deny string) *typePolicy {
+	p := &typePolicy{allow: splitList(allow), deny: splitList(deny)}
+	if len(p.allow) == 0 && len(p.deny) == 0 {
+		return nil
+	}
+	return p
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// typeError rejects an upload because of its type.
+type typeError struct {
+	reason string
+}
+
+func (e *typeError) Error() string {
+	return e.reason
+}
+
+// check vets a file by its sniffed type, the type the client declared and
+// its extension. Any of them on the deny list rejects it. With an allow
+// list, a listed extension or listed types are enough: the file passes if
+// its extension is listed and the content agrees with it, or if each of its
+// types is listed. A generic sniffed type such as text/plain is left out
+// when it agrees with what the file claims to be. detected is empty while
+// the content hasn't been seen yet, so the rest can be checked up front.
+func (p *typePolicy) check(detected, declared, filename string) error {
+	if p == nil {
+		return nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	extType := extensionType(ext)
+	types := []struct{ source, mimeType string }{
+		{"Content detected as", detected},
+		{"Declared type", declaredType(declared)},
+		{"Extension " + ext + " implies", extType},
+	}
+
+	for _, pattern := range p.deny {
+		if pattern == ext {
+			return &typeError{fmt.Sprintf("Extension %q is not allowed", ext)}
+		}
+		for _, t := range types {
+			if t.mimeType != "" && matchMimeType(pattern, t.mimeType) {
+				return &typeError{fmt.Sprintf("%s %s, which is not allowed", t.source, t.mimeType)}
+			}
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+
+	if slices.Contains(p.allow, ext) && agrees(detected, extType) {
+		return nil
+	}
+
+	var allowedTypes []string
+	for _, pattern := range p.allow {
+		if !strings.HasPrefix(pattern, ".") {
+			allowedTypes = append(allowedTypes, pattern)
+		}
+	}
+	if len(allowedTypes) == 0 {
+		if slices.Contains(p.allow, ext) {
+			return &typeError{fmt.Sprintf("Content detected as %s, which doesn't match %s", detected, ext)}
+		}
+		return &typeError{fmt.Sprintf("Extension %q is not allowed", ext)}
+	}
+	claims := []string{types[1].mimeType, extType}
+	deferred := slices.ContainsFunc(claims, func(claimed string) bool { return claimed != "" && agrees(detected, claimed) })
+	for i, t := range types {
+		if t.mimeType == "" || (i == 0 && deferred) {
+			// A sniffed type that agrees with a claimed one is checked as that
+			continue
+		}
+		allowed := func(pattern string) bool { return matchMimeType(pattern, t.mimeType) }
+		if !slices.ContainsFunc(allowedTypes, allowed) {
+			return &typeError{fmt.Sprintf("%s %s, which is not allowed", t.source, t.mimeType)}
+		}
+	}
+	return nil
+}
+
+// declaredType is the client's Content-Type, unless it is missing or
+// generic.
+func declaredType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	return mediaType
+}
+
+// extensionType is the MIME type registered for ext, if any.
+func extensionType(ext string) string {
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	return mediaType
+}
+
+// matchMimeType compares a pattern such as "image/*" with a MIME type,
+// ignoring parameters and case.
+func matchMimeType(pattern, mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	ok, _ := path.Match(pattern, mediaType)
+	return ok
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDetectType(t *testing.T) {
+	tests := []struct {
+		head string
+		want string
+	}{
+		{"\x7fELF\x02\x01\x01", "application/x-executable"},
+		{"MZ\x90\x00\x03", "application/octet-stream"},
+		{"7z\xbc\xaf\x27\x1c\x00\x04", "application/x-7z-compressed"},
+		{strings.Repeat("\x00", 257) + "ustar\x0000", "application/x-tar"},
+		{"PK\x03\x04", "application/zip"},
+		{"\x89PNG\r\n\x1a\n", "image/png"},
+		{"hello world", "text/plain"},
+		{"MZ, or Mozart, is a composer", "text/plain"},
+		{"#!important note", "text/plain"},
+		{"BZh is not bzip2", "text/plain"},
+		{"#!/bin/sh\necho hi", "text/x-shellscript"},
+		{"BZh91AY&SY\x00\x00", "application/x-bzip2"},
+	}
+	for _, tt := range tests {
+		if got := detectType([]byte(tt.head)); got != tt.want {
+			t.Errorf("detectType(%q) = %s, want %s", tt.head[:min(len(tt.head), 8)], got, tt.want)
+		}
+	}
+
+	// A DOS header pointing at the PE signature
+	pe := make([]byte, 0x84)
+	copy(pe, "MZ\x90\x00")
+	pe[0x3c] = 0x80
+	copy(pe[0x80:], "PE\x00\x00")
+	if got := detectType(pe); got != "application/vnd.microsoft.portable-executable" {
+		t.Errorf("detectType(PE) = %s", got)
+	}
+	pe[0x3c] = 0xf0
+	if got := detectType(pe); got == "application/vnd.microsoft.portable-executable" {
+		t.Errorf("Expected MZ without a PE signature not to be an executable")
+	}
+}
+
+func TestTypePolicy(t *testing.T) {
+	t.Run("no lists accepts everything", func(t *testing.T) {
+		if newTypePolicy(" ", "") != nil {
+			t.Errorf("Expected nil policy")
+		}
+		var p *typePolicy
+		if err := p.check("application/x-executable", "", "a.exe"); err != nil {
+			t.Errorf("Expected nil policy to accept, got %v", err)
+		}
+	})
+
+	deny := newTypePolicy("", "application/x-executable, application/wasm, .bat")
+	readme := newTypePolicy("image/*,application/pdf,.csv", "")
+	docx := "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	tests := []struct {
+		name                         string
+		policy                       *typePolicy
+		detected, declared, filename string
+		rejected                     bool
+	}{
+		{"denied content", deny, "application/x-executable", "image/png", "cat.png", true},
+		{"denied extension", deny, "text/plain", "", "run.BAT", true},
+		{"denied extension type", deny, "", "", "module.wasm", true},
+		{"other files pass", deny, "text/plain", "text/plain", "notes.txt", false},
+		{"allowed images", newTypePolicy("image/*", ""), "image/png", "image/png", "cat.png", false},
+		{"allowlist checks content", newTypePolicy("image/*", ""), "application/zip", "image/png", "cat.png", true},
+		{"allowlist checks extension", newTypePolicy("image/*", ""), "image/png", "", "cat.html", true},
+		{"generic declared type is ignored", newTypePolicy("image/*", ""), "image/png", "application/octet-stream", "cat.png", false},
+		{"extension allowlist", newTypePolicy(".csv", ""), "text/plain", "", "data.txt", true},
+		{"extension or type", newTypePolicy(".csv, text/*", ""), "text/plain", "", "data.txt", false},
+		{"listed extension with other content", newTypePolicy(".csv", ""), "image/png", "", "data.csv", true},
+		// MIME_ALLOW=image/*,application/pdf,.csv from the README
+		{"README image", readme, "image/png", "image/png", "cat.png", false},
+		{"README pdf", readme, "application/pdf", "application/pdf", "report.pdf", false},
+		{"README csv", readme, "text/plain", "text/csv", "data.csv", false},
+		{"README csv without type", readme, "text/plain", "", "data.csv", false},
+		{"README text", readme, "text/plain", "text/plain", "notes.txt", true},
+		// Formats that are sniffed as generic types
+		{"json", newTypePolicy("application/json", ""), "text/plain", "application/json", "data.json", false},
+		{"json by extension", newTypePolicy("application/json", ""), "text/plain", "", "data.json", false},
+		{"csv", newTypePolicy("text/csv", ""), "text/plain", "text/csv", "data.csv", false},
+		{"docx", newTypePolicy(docx, ""), "application/zip", docx, "letter.docx", false},
+		{"generic content without a claimed type", newTypePolicy("application/json", ""), "text/plain", "", "data", true},
+		{"zip is not an image", newTypePolicy("image/*", ""), "application/zip", "image/png", "cat", true},
+		{"html is not csv", newTypePolicy("text/csv", ""), "text/html", "text/csv", "data.csv", true},
+		// Unrecognized binaries can't pass as formats the sniffer knows
+		{"binary named as image", newTypePolicy("image/*", ""), "application/octet-stream", "", "x.png", true},
+		{"binary declared as image", newTypePolicy("image/*", ""), "application/octet-stream", "image/png", "x", true},
+		{"binary with a listed image extension", newTypePolicy(".png", ""), "application/octet-stream", "", "x.png", true},
+		{"binary declared as pdf", newTypePolicy("application/pdf", ""), "application/octet-stream", "application/pdf", "x.pdf", true},
+		{"binary format the sniffer doesn't know", newTypePolicy("application/x-sqlite3", ""), "application/octet-stream", "application/x-sqlite3", "data.db", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(tt.detected, tt.declared, tt.filename)
+			var typeErr *typeError
+			if tt.rejected != errors.As(err, &typeErr) {
+				t.Errorf("Expected rejected=%v, got %v", tt.rejected, err)
+			}
+		})
+	}
+}
+
+func TestStoreFileTypePolicy(t *testing.T) {
+	store, _ := newFileStorage(t.TempDir())
+	names, _ := newNamer(defaultNameTemplate)
+	policy := newTypePolicy("", "application/x-executable")
+
+	src := newChecksumReader(strings.NewReader("\x7fELF"+strings.Repeat("\x00", 1000)), nil, nil)
+	result := storeFile(store, names, policy, "report.pdf", "application/pdf", src, uploadOrigin{})
+	if result.Status != 415 || result.Error == nil || result.Error.Code != codeUnsupportedMediaType {
+		t.Fatalf("Expected 415 unsupported_media_type, got %d %+v", result.Status, result.Error)
+	}
+	if !strings.Contains(result.Error.Message, "application/x-executable") {
+		t.Errorf("Expected the detected type in the reason, got '%s'", result.Error.Message)
+	}
+	if files, _ := store.List(); len(files) != 0 {
+		t.Errorf("Expected nothing stored, got %v", files)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// indexFiles maps a time-ordered key (timestamp, then name) to the
+	// JSON fileEntry, so time ranges are a cursor seek
+	indexFiles = []byte("files")
+	// indexNames maps a stored name to its key in indexFiles
+	indexNames = []byte("names")
+)
+
+// metaIndex is an on-disk index of the stored files and their metadata, so
+// listings don't have to walk the storage backend and read every sidecar.
+type metaIndex struct {
+	db *bolt.DB
+}
+
+// openIndex opens the index at path, creating it if needed. It reports
+// whether the index was newly created and needs to be filled.
+func openIndex(path string) (*metaIndex, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, false, err
+	}
+	_, err := os.Stat(path)
+	created := errors.Is(err, fs.ErrNotExist)
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, false, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(indexFiles); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(indexNames)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+	return &metaIndex{db: db}, created, nil
+}
+
+func (idx *metaIndex) Close() error {
+	return idx.db.Close()
+}
+
+// indexKey orders entries by timestamp, with the name keeping keys unique.
+func indexKey(entry fileEntry) []byte {
+	key := make([]byte, 8, 8+len(entry.StoredName))
+	binary.BigEndian.PutUint64(key, uint64(max(entry.Timestamp.UnixNano(), 0)))
+	return append(key, entry.StoredName...)
+}
+
+// put adds or replaces the entries, in a single transaction.
+func (idx *metaIndex) put(entries ...fileEntry) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		files, names := tx.Bucket(indexFiles), tx.Bucket(indexNames)
+		for _, entry := range entries {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if old := names.Get([]byte(entry.StoredName)); old != nil {
+				if err := files.Delete(old); err != nil {
+					return err
+				}
+			}
+			key := indexKey(entry)
+			if err := files.Put(key, value); err != nil {
+				return err
+			}
+			if err := names.Put([]byte(entry.StoredName), key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// remove drops the entries for the names, if any, in a single transaction.
+func (idx *metaIndex) remove(storedNames ...string) error {
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		files, names := tx.Bucket(indexFiles), tx.Bucket(indexNames)
+		for _, name := range storedNames {
+			key := names.Get([]byte(name))
+			if key == nil {
+				continue
+			}
+			if err := files.Delete(key); err != nil {
+				return err
+			}
+			if err := names.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// fileFilter selects entries from the index. Zero values match everything.
+type fileFilter struct {
+	Prefix   string
+	After    time.Time
+	Before   time.Time
+	MinSize  int64
+	MaxSize  int64
+	MimeType string // exact, or "type/*"
+	Tag      string
+	Uploader string // SFTP user or client IP
+}
+
+func (f fileFilter) match(entry fileEntry) bool {
+	switch {
+	case !strings.HasPrefix(entry.StoredName, f.Prefix):
+		return false
+	case !f.After.IsZero() && !entry.Timestamp.After(f.After):
+		return false
+	case !f.Before.IsZero() && !entry.Timestamp.Before(f.Before):
+		return false
+	case entry.Size < f.MinSize:
+		return false
+	case f.MaxSize > 0 && entry.Size > f.MaxSize:
+		return false
+	case f.MimeType != "" && !matchMimeType(f.MimeType, entry.MimeType) && !matchMimeType(f.MimeType, entry.DetectedMimeType):
+		return false
+	}
+
+	var origin uploadOrigin
+	if entry.Origin != nil {
+		origin = *entry.Origin
+	}
+	if f.Uploader != "" && f.Uploader != origin.User && f.Uploader != origin.ClientIP {
+		return false
+	}
+	if f.Tag != "" {
+		for _, tag := range origin.Tags {
+			if tag == f.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// query returns the matching entries, oldest first.
+func (idx *metaIndex) query(f fileFilter) ([]fileEntry, error) {
+	entries := []fileEntry{}
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(indexFiles).Cursor()
+		k, v := c.First()
+		if !f.After.IsZero() {
+			k, v = c.Seek(indexKey(fileEntry{Timestamp: f.After}))
+		}
+		for ; k != nil; k, v = c.Next() {
+			var entry fileEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("index entry %q: %w", k[8:], err)
+			}
+			if !f.Before.IsZero() && !entry.Timestamp.Before(f.Before) {
+				break
+			}
+			if f.match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// indexedStorage keeps a metaIndex in step with the files and metadata
+// sidecars written and deleted through it.
+type indexedStorage struct {
+	Storage
+	index *metaIndex
+	names *namer
+}
+
+// newIndexedStorage wraps store with the index at path, bringing the
+// index in line with store, or building it if it didn't exist.
+func newIndexedStorage(store Storage, names *namer, path string) (*indexedStorage, error) {
+	index, created, err := openIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &indexedStorage{Storage: store, index: index, names: names}
+	if err := s.reconcile(); err != nil {
+		index.Close()
+		if created {
+			// Start over on the next attempt rather than trust a partial index
+			os.Remove(path)
+		}
+		return nil, fmt.Errorf("reconciling index: %w", err)
+	}
+	return s, nil
+}
+
+// reconcile indexes the stored files that are missing from the index or
+// changed size, and drops entries for files that are gone, e.g. after they
+// were added or deleted outside the application while it was down.
+func (s *indexedStorage) reconcile() error {
+	infos, err := s.Storage.List()
+	if err != nil {
+		return err
+	}
+	indexed, err := s.index.query(fileFilter{})
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64, len(indexed))
+	for _, entry := range indexed {
+		sizes[entry.StoredName] = entry.Size
+	}
+
+	var entries []fileEntry
+	for _, info := range infos {
+		if size, ok := sizes[info.Name]; !ok || size != info.Size {
+			entries = append(entries, s.entry(info))
+		}
+		delete(sizes, info.Name)
+	}
+	stale := make([]string, 0, len(sizes))
+	for name := range sizes {
+		stale = append(stale, name)
+	}
+	if err := s.index.put(entries...); err != nil {
+		return err
+	}
+	if err := s.index.remove(stale...); err != nil {
+		return err
+	}
+	if len(entries) > 0 || len(stale) > 0 {
+		log.Printf("Indexed %d stored file(s), dropped %d missing", len(entries), len(stale))
+	}
+	return nil
+}
+
+func (s *indexedStorage) entry(info FileInfo) fileEntry {
+	entry := newFileEntry(info, s.names)
+	if meta, ok := readMeta(s.Storage, info); ok {
+		entry = entry.withMeta(meta)
+	}
+	return entry
+}
+
+// reindex refreshes the entry for the stored file name after it or its
+// sidecar changed.
+func (s *indexedStorage) reindex(name string) {
+	info, err := s.Storage.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = s.index.remove(name)
+	} else if err == nil {
+		err = s.index.put(s.entry(info))
+	}
+	if err != nil {
+		log.Printf("Failed to update index for %s: %v", name, err)
+	}
+}
+
+// fileName returns the stored file name for a name written through the
+// storage, which is the file itself or its sidecar.
+func fileName(name string) string {
+	if rest, ok := strings.CutPrefix(name, metaDir+"/"); ok {
+		return rest
+	}
+	return name
+}
+
+func (s *indexedStorage) Put(name string, r io.Reader) (int64, error) {
+	n, err := s.Storage.Put(name, r)
+	if err == nil {
+		s.reindex(fileName(name))
+	}
+	return n, err
+}
+
+func (s *indexedStorage) Replace(name string, r io.Reader) (int64, error) {
+	n, err := s.Storage.Replace(name, r)
+	if err == nil {
+		s.reindex(fileName(name))
+	}
+	return n, err
+}
+
+// Get and Stat drop the entry for a file that has gone missing, so it
+// doesn't linger in listings after being deleted behind the index's back.
+func (s *indexedStorage) Get(name string) (io.ReadSeekCloser, error) {
+	rc, err := s.Storage.Get(name)
+	s.forgetMissing(name, err)
+	return rc, err
+}
+
+func (s *indexedStorage) Stat(name string) (FileInfo, error) {
+	info, err := s.Storage.Stat(name)
+	s.forgetMissing(name, err)
+	return info, err
+}
+
+func (s *indexedStorage) forgetMissing(name string, err error) {
+	if errors.Is(err, fs.ErrNotExist) && fileName(name) == name {
+		if err := s.index.remove(name); err != nil {
+			log.Printf("Failed to update index for %s: %v", name, err)
+		}
+	}
+}
+
+func (s *indexedStorage) Delete(name string) error {
+	err := s.Storage.Delete(name)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		s.reindex(fileName(name))
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexedStorage(t *testing.T) {
+	dir := t.TempDir()
+	names, _ := newNamer(defaultNameTemplate)
+	base, _ := newFileStorage(filepath.Join(dir, "uploads"))
+	base.Put("20250101_120000_000000_aaaaaaaa_old.txt", strings.NewReader("old"))
+
+	store, err := newIndexedStorage(base, names, filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatalf("newIndexedStorage failed: %v", err)
+	}
+	defer store.index.Close()
+
+	t.Run("existing files are indexed on first open", func(t *testing.T) {
+		entries, _ := store.index.query(fileFilter{})
+		if len(entries) != 1 || entries[0].Filename != "old.txt" {
+			t.Fatalf("Expected old.txt to be indexed, got %+v", entries)
+		}
+	})
+
+	t.Run("writes, sidecars and deletes update the index", func(t *testing.T) {
+		result := uploadResult{Filename: "new.txt", StoredName: "20250601_120000_000000_bbbbbbbb_new.txt", Size: 3, Timestamp: time.Now()}
+		store.Put(result.StoredName, strings.NewReader("new"))
+		writeMeta(store, result, uploadOrigin{Protocol: "upload", Tags: []string{"nightly"}})
+
+		entries, _ := store.index.query(fileFilter{Tag: "nightly"})
+		if len(entries) != 1 || entries[0].StoredName != result.StoredName {
+			t.Fatalf("Expected tagged entry, got %+v", entries)
+		}
+
+		removeFile(store, result.StoredName)
+		if entries, _ := store.index.query(fileFilter{}); len(entries) != 1 {
+			t.Errorf("Expected deleted file to leave the index, got %+v", entries)
+		}
+	})
+
+	t.Run("files deleted behind the index are dropped", func(t *testing.T) {
+		gone := "20250401_120000_000000_dddddddd_gone.txt"
+		store.Put(gone, strings.NewReader("gone"))
+		base.Delete(gone)
+		if _, err := store.Stat(gone); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Expected ErrNotExist, got %v", err)
+		}
+		if entries, _ := store.index.query(fileFilter{Prefix: gone}); len(entries) != 0 {
+			t.Errorf("Expected the missing file to leave the index, got %+v", entries)
+		}
+
+		store.Put(gone, strings.NewReader("gone"))
+		base.Delete(gone)
+		if err := removeFile(store, gone); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Expected ErrNotExist, got %v", err)
+		}
+		if entries, _ := store.index.query(fileFilter{Prefix: gone}); len(entries) != 0 {
+			t.Errorf("Expected removeFile to drop the entry, got %+v", entries)
+		}
+	})
+
+	t.Run("time range", func(t *testing.T) {
+		store.Put("20250301_120000_000000_cccccccc_mid.txt", strings.NewReader("mid"))
+		entries, _ := store.index.query(fileFilter{
+			After:  time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+			Before: time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC),
+		})
+		if len(entries) != 1 || entries[0].Filename != "mid.txt" {
+			t.Errorf("Expected only mid.txt, got %+v", entries)
+		}
+	})
+}
+
+func TestIndexReconcile(t *testing.T) {
+	dir := t.TempDir()
+	names, _ := newNamer(defaultNameTemplate)
+	base, _ := newFileStorage(filepath.Join(dir, "uploads"))
+	kept, deleted, added := "20250101_120000_000000_aaaaaaaa_kept.txt", "20250102_120000_000000_bbbbbbbb_deleted.txt", "20250103_120000_000000_cccccccc_added.txt"
+	base.Put(kept, strings.NewReader("kept"))
+	base.Put(deleted, strings.NewReader("deleted"))
+
+	store, err := newIndexedStorage(base, names, filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatalf("newIndexedStorage failed: %v", err)
+	}
+	store.index.Close()
+
+	// Changes made while the application is down
+	base.Delete(deleted)
+	base.Put(added, strings.NewReader("added"))
+
+	store, err = newIndexedStorage(base, names, filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatalf("newIndexedStorage failed: %v", err)
+	}
+	defer store.index.Close()
+	entries, _ := store.index.query(fileFilter{})
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.StoredName)
+	}
+	if strings.Join(got, ",") != kept+","+added {
+		t.Errorf("Expected the index to match the storage, got %v", got)
+	}
+}
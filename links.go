@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLinkExpiry is how long a signed upload link is valid unless the
+// minter asks otherwise.
+const defaultLinkExpiry = 24 * time.Hour
+
+// maxLinkPrefixLen limits the filename prefix of a link, leaving most of
+// the 255 byte filename for the uploaded name.
+const maxLinkPrefixLen = 64
+
+var (
+	errLinkInvalid = errors.New("Invalid upload link")
+	errLinkExpired = errors.New("Upload link has expired")
+	errLinkUsed    = errors.New("Upload link has already been used")
+)
+
+// uploadLink is what a signed upload URL allows: one file, before Expires,
+// of at most MaxSize bytes (0 for MAX_SIZE), its filename starting with
+// Prefix.
+type uploadLink struct {
+	Expires time.Time
+	MaxSize int64
+	Prefix  string
+	Nonce   string
+}
+
+// uploadLinks mints and checks signed upload URLs. Links are signed with
+// an HMAC key, so they need no server-side state until they are used; a
+// marker file per used link makes each one single-use.
+type uploadLinks struct {
+	key  []byte
+	used string
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// newUploadLinks uses secret as the signing key, or the key in dir,
+// generated on first start. Used-link markers are kept in dir as well.
+func newUploadLinks(dir, secret string) (*uploadLinks, error) {
+	l := &uploadLinks{key: []byte(secret), used: filepath.Join(dir, "used")}
+	if err := os.MkdirAll(l.used, 0700); err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		key, err := loadOrCreateLinkKey(filepath.Join(dir, "key"))
+		if err != nil {
+			return nil, err
+		}
+		l.key = key
+	}
+	return l, nil
+}
+
+func loadOrCreateLinkKey(keyPath string) ([]byte, error) {
+	key, err := os.ReadFile(keyPath)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated upload link key %s", keyPath)
+	return key, nil
+}
+
+func (l *uploadLinks) signature(link uploadLink) string {
+	mac := hmac.New(sha256.New, l.key)
+	fmt.Fprintf(mac, "upload\n%d\n%d\n%s\n%s", link.Expires.Unix(), link.MaxSize, link.Prefix, link.Nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns the query string that grants link on POST /upload.
+func (l *uploadLinks) sign(link uploadLink) url.Values {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(link.Expires.Unix(), 10))
+	if link.MaxSize > 0 {
+		query.Set("max_size", strconv.FormatInt(link.MaxSize, 10))
+	}
+	if link.Prefix != "" {
+		query.Set("prefix", link.Prefix)
+	}
+	query.Set("nonce", link.Nonce)
+	query.Set("sig", l.signature(link))
+	return query
+}
+
+// newLink builds a link valid for expiresIn with a fresh nonce.
+func newLink(expiresIn time.Duration, maxSize int64, prefix string) (uploadLink, error) {
+	switch {
+	case expiresIn <= 0:
+		return uploadLink{}, errors.New("expiry must be positive")
+	case maxSize < 0:
+		return uploadLink{}, errors.New("max size must not be negative")
+	case prefix != "" && !validLinkPrefix(prefix):
+		return uploadLink{}, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	return uploadLink{Expires: time.Now().Add(expiresIn).Truncate(time.Second), MaxSize: maxSize, Prefix: prefix, Nonce: randomHex(16)}, nil
+}
+
+// validLinkPrefix accepts filename prefixes that sanitizing leaves alone
+// and that can't hide the file or reach into a directory.
+func validLinkPrefix(prefix string) bool {
+	return len(prefix) <= maxLinkPrefixLen && !strings.HasPrefix(prefix, ".") && prefix == sanitizeFilenameWithMaxLen(prefix, maxLinkPrefixLen)
+}
+
+// verify checks the signature and expiry of the link in query.
+func (l *uploadLinks) verify(query url.Values) (uploadLink, error) {
+	expires, errE := strconv.ParseInt(query.Get("expires"), 10, 64)
+	maxSize, errM := queryInt(query.Get("max_size"), 0)
+	link := uploadLink{Expires: time.Unix(expires, 0), MaxSize: int64(maxSize), Prefix: query.Get("prefix"), Nonce: query.Get("nonce")}
+	if errE != nil || errM != nil || link.Nonce == "" || !hmac.Equal([]byte(query.Get("sig")), []byte(l.signature(link))) {
+		return link, errLinkInvalid
+	}
+	if link.Prefix != "" && !validLinkPrefix(link.Prefix) {
+		// Signed before prefixes were filename prefixes
+		return link, errLinkInvalid
+	}
+	if time.Now().After(link.Expires) {
+		return link, errLinkExpired
+	}
+	return link, nil
+}
+
+// claim marks link as used, failing with errLinkUsed if it already was.
+// The marker expires with the link.
+func (l *uploadLinks) claim(link uploadLink) error {
+	l.sweep()
+	f, err := os.OpenFile(filepath.Join(l.used, link.Nonce), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return errLinkUsed
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Chtimes(f.Name(), link.Expires, link.Expires)
+}
+
+func (l *uploadLinks) isUsed(link uploadLink) bool {
+	_, err := os.Stat(filepath.Join(l.used, link.Nonce))
+	return err == nil
+}
+
+// release makes link usable again after an upload that stored nothing.
+func (l *uploadLinks) release(link uploadLink) {
+	os.Remove(filepath.Join(l.used, link.Nonce))
+}
+
+// sweep removes markers of expired links, at most once an hour.
+func (l *uploadLinks) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.lastSweep) < time.Hour {
+		return
+	}
+	l.lastSweep = time.Now()
+	entries, err := os.ReadDir(l.used)
+	if err != nil {
+		log.Printf("Failed to sweep used upload links: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(time.Now()) {
+			os.Remove(filepath.Join(l.used, entry.Name()))
+		}
+	}
+}
+
+// checkLink verifies the signed upload link r was sent to and, for POST,
+// claims it, writing an error response and returning false if it can't be
+// used. A declared body larger than the link allows is refused before
+// claiming.
+func (l *uploadLinks) checkLink(w http.ResponseWriter, r *http.Request) (uploadLink, bool) {
+	link, err := uploadLink{}, errLinkInvalid
+	if l != nil {
+		link, err = l.verify(r.URL.Query())
+	}
+	if err == nil && r.Method != http.MethodPost && l.isUsed(link) {
+		err = errLinkUsed
+	}
+	switch {
+	case errors.Is(err, errLinkExpired), errors.Is(err, errLinkUsed):
+		writeError(w, r, http.StatusGone, codeNotFound, err.Error())
+		return link, false
+	case err != nil:
+		writeError(w, r, http.StatusForbidden, codeForbidden, err.Error())
+		return link, false
+	case r.Method != http.MethodPost:
+		return link, true
+	case link.MaxSize > 0 && r.ContentLength > link.MaxSize+64*1024:
+		// Leaves room for the multipart framing around the file
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeFileTooLarge, "File too large")
+		return link, false
+	}
+
+	if err := l.claim(link); err != nil {
+		if errors.Is(err, errLinkUsed) {
+			writeError(w, r, http.StatusGone, codeNotFound, err.Error())
+		} else {
+			writeStorageError(w, r, err, "Failed to check upload link")
+		}
+		return link, false
+	}
+	return link, true
+}
+
+// linkRequest is the body of POST /admin/upload-links.
+type linkRequest struct {
+	ExpiresIn string `json:"expires_in"`
+	MaxSize   int64  `json:"max_size"`
+	Prefix    string `json:"prefix"`
+}
+
+// linkResponse describes a minted upload link.
+type linkResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	MaxSize int64     `json:"max_size,omitempty"`
+	Prefix  string    `json:"prefix,omitempty"`
+}
+
+// linkHandler serves POST /admin/upload-links, minting a signed upload
+// URL whose base is baseURL(r, publicURL).
+func linkHandler(links *uploadLinks, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		req := linkRequest{ExpiresIn: defaultLinkExpiry.String()}
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid JSON body")
+			return
+		}
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid expires_in (e.g. 24h)")
+			return
+		}
+		link, err := newLink(expiresIn, req.MaxSize, req.Prefix)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, linkResponse{
+			URL:     linkURL(baseURL(r, publicURL), links.sign(link)),
+			Expires: link.Expires,
+			MaxSize: link.MaxSize,
+			Prefix:  link.Prefix,
+		})
+	}
+}
+
+// baseURL is the server's external base URL: publicURL if set, otherwise
+// built from the request's Host.
+func baseURL(r *http.Request, publicURL string) string {
+	if publicURL != "" {
+		return publicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func linkURL(base string, query url.Values) string {
+	return strings.TrimSuffix(base, "/") + "/upload?" + query.Encode()
+}
+
+// signUploadLinkCommand implements "file-upload-web sign-upload-link",
+// which mints a link offline with the same key as the server.
+func signUploadLinkCommand(args []string) error {
+	flags := flag.NewFlagSet("sign-upload-link", flag.ContinueOnError)
+	expiresIn := flags.Duration("expires", defaultLinkExpiry, "how long the link is valid")
+	maxSize := flags.Int64("max-size", 0, "maximum file size in bytes (default MAX_SIZE)")
+	prefix := flags.String("prefix", "", "prefix for the stored filename, e.g. acme-")
+	base := flags.String("url", getEnv("PUBLIC_URL", "http://localhost:"+getEnv("PORT", "8080")), "base URL of the server")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	links, err := newUploadLinks(filepath.Join(getEnv("UPLOAD_DIR", "./uploads"), ".links"), getEnv("LINK_SECRET", ""))
+	if err != nil {
+		return err
+	}
+	link, err := newLink(*expiresIn, *maxSize, *prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Println(linkURL(*base, links.sign(link)))
+	return nil
+}
@@ -2,9 +2,8 @@ package main
 
 import (
 	_ "embed"
-	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,9 +16,21 @@ import (
 var indexHTML string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign-upload-link" {
+		if err := signUploadLinkCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	port := getEnv("PORT", "8080")
 	uploadDir := getEnv("UPLOAD_DIR", "./uploads")
 	maxSizeStr := getEnv("MAX_SIZE", "10")
+	storageBackend := getEnv("STORAGE_BACKEND", "filesystem")
+	nameTemplate := getEnv("NAME_TEMPLATE", defaultNameTemplate)
+	tusExpiryStr := getEnv("TUS_EXPIRY", "24h")
+	indexPath := getEnv("INDEX_PATH", filepath.Join(uploadDir, ".index.db"))
+	types := newTypePolicy(getEnv("MIME_ALLOW", ""), getEnv("MIME_DENY", ""))
 
 	maxSize, err := strconv.ParseInt(maxSizeStr, 10, 64)
 	if err != nil {
@@ -27,21 +38,119 @@ func main() {
 	}
 	maxSizeBytes := maxSize * 1024 * 1024
 
-	// Ensure upload directory exists
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Fatalf("Failed to create upload directory: %v", err)
+	tusExpiry, err := time.ParseDuration(tusExpiryStr)
+	if err != nil || tusExpiry <= 0 {
+		tusExpiry = 24 * time.Hour
+	}
+
+	store, err := newStorage(storageBackend, uploadDir)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	names, err := newNamer(nameTemplate)
+	if err != nil {
+		log.Fatalf("Invalid NAME_TEMPLATE: %v", err)
+	}
+	auth, err := newAuthenticator(getEnv("AUTH_TOKENS_FILE", ""), getEnv("AUTH_TOKENS", ""))
+	if err != nil {
+		log.Fatalf("Failed to load API tokens: %v", err)
+	}
+	auth.jwt, err = newJWTVerifier(oidcConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Failed to set up OIDC: %v", err)
+	}
+	indexed, err := newIndexedStorage(store, names, indexPath)
+	if err != nil {
+		log.Fatalf("Failed to open metadata index: %v", err)
+	}
+	store = indexed
+	janitor, err := newJanitor(retentionConfigFromEnv(), store, indexed.index)
+	if err != nil {
+		log.Fatalf("Invalid retention policy: %v", err)
+	}
+	// Partial resumable uploads always live on local disk, whatever the backend
+	tus, err := newTusHandler(filepath.Join(uploadDir, ".tus"), store, names, types, maxSizeBytes, tusExpiry)
+	if err != nil {
+		log.Fatalf("Failed to initialize resumable uploads: %v", err)
+	}
+	links, err := newUploadLinks(filepath.Join(uploadDir, ".links"), getEnv("LINK_SECRET", ""))
+	if err != nil {
+		log.Fatalf("Failed to initialize upload links: %v", err)
+	}
+	shares, err := newShareHandler(filepath.Join(uploadDir, ".shares"), store, names, getEnv("PUBLIC_URL", ""))
+	if err != nil {
+		log.Fatalf("Failed to initialize download shares: %v", err)
+	}
+	boxes, err := newBoxHandler(filepath.Join(uploadDir, ".boxes"), store, names, types, maxSizeBytes, getEnv("PUBLIC_URL", ""))
+	if err != nil {
+		log.Fatalf("Failed to initialize drop boxes: %v", err)
+	}
+	chunks, err := newChunkHandler(filepath.Join(uploadDir, ".chunks"), store, names, types, maxSizeBytes, tusExpiry)
+	if err != nil {
+		log.Fatalf("Failed to initialize chunked uploads: %v", err)
 	}
 
 	// Setup routes
 	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/upload", uploadHandler(uploadDir, maxSizeBytes))
+	http.HandleFunc("/upload", uploadHandler(store, names, types, links, maxSizeBytes))
+	http.HandleFunc("/admin/upload-links", linkHandler(links, getEnv("PUBLIC_URL", "")))
+	http.HandleFunc("/admin/shares", shares.admin)
+	http.HandleFunc("/admin/shares/", shares.admin)
+	http.Handle("/s/", shares)
+	http.HandleFunc("/admin/boxes", boxes.admin)
+	http.HandleFunc("/admin/boxes/", boxes.admin)
+	http.Handle("/box/", boxes)
+	http.HandleFunc("/files", listHandler(indexed.index))
+	http.HandleFunc("/files/", fileHandler(store, names, types, maxSizeBytes))
+	http.HandleFunc("/files/delete", bulkDeleteHandler(store, names))
+	http.Handle("/tus/", tus)
+	http.Handle("/chunks", chunks)
+	http.Handle("/chunks/", chunks)
+	dav := newDavHandler(store, names, types, maxSizeBytes)
+	http.Handle("/dav", dav)
+	http.Handle("/dav/", dav)
 	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/metrics", janitor.metricsHandler)
+
+	sftpCfg := sftpConfigFromEnv(uploadDir)
+	if sftpCfg.Port != "" {
+		sftp, err := newSFTPServer(sftpCfg, filepath.Join(uploadDir, ".sftp", "staging"), store, names, types, maxSizeBytes)
+		if err != nil {
+			log.Fatalf("Failed to initialize SFTP: %v", err)
+		}
+		listener, err := net.Listen("tcp", ":"+sftpCfg.Port)
+		if err != nil {
+			log.Fatalf("SFTP server failed to start: %v", err)
+		}
+		go func() {
+			log.Fatalf("SFTP server failed: %v", sftp.Serve(listener))
+		}()
+		log.Printf("SFTP server listening on port %s (user %s)", sftpCfg.Port, sftpCfg.User)
+	}
 
 	log.Printf("Server starting on port %s", port)
+	log.Printf("Storage backend: %s", storageBackend)
 	log.Printf("Upload directory: %s", uploadDir)
+	log.Printf("Name template: %s", nameTemplate)
 	log.Printf("Max file size: %d MB", maxSize)
+	log.Printf("Resumable upload expiry: %s", tusExpiry)
+	if auth.enabled() {
+		log.Printf("Authentication: %d API token(s)", len(auth.tokens))
+		if auth.jwt != nil {
+			log.Printf("Authentication: JWTs from %s via %s", auth.jwt.issuer, auth.jwt.keys.source)
+		}
+	} else {
+		log.Printf("Authentication: disabled (no API tokens or OIDC key set)")
+	}
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if janitor != nil {
+		log.Printf("Retention: %s", janitor)
+		go janitor.run()
+	} else {
+		log.Printf("Retention: disabled (files are kept forever)")
+	}
+
+	if err := http.ListenAndServe(":"+port, auth.middleware(http.DefaultServeMux)); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
@@ -61,65 +170,6 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(indexHTML))
 }
 
-func uploadHandler(uploadDir string, maxSizeBytes int64) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		// Parse multipart form with size limit
-		r.Body = http.MaxBytesReader(w, r.Body, maxSizeBytes)
-		if err := r.ParseMultipartForm(maxSizeBytes); err != nil {
-			if err.Error() == "http: request body too large" {
-				http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
-				return
-			}
-			http.Error(w, "Failed to parse form", http.StatusBadRequest)
-			return
-		}
-
-		// Get file from form
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "No file provided", http.StatusBadRequest)
-			return
-		}
-		defer file.Close()
-
-		// Create timestamp first
-		timestamp := time.Now().Format("20060102_150405")
-
-		// Sanitize filename - account for timestamp in length limit
-		// Timestamp format "20060102_150405_" is 16 chars
-		filename := sanitizeFilenameWithMaxLen(header.Filename, 255-16)
-
-		// Create final filename
-		finalName := fmt.Sprintf("%s_%s", timestamp, filename)
-		filepath := filepath.Join(uploadDir, finalName)
-
-		// Create destination file
-		dst, err := os.Create(filepath)
-		if err != nil {
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
-			log.Printf("Failed to create file: %v", err)
-			return
-		}
-		defer dst.Close()
-
-		// Stream file to disk
-		if _, err := io.Copy(dst, file); err != nil {
-			http.Error(w, "Failed to save file", http.StatusInternalServerError)
-			log.Printf("Failed to write file: %v", err)
-			return
-		}
-
-		log.Printf("File uploaded: %s", finalName)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprintf(w, "File uploaded successfully: %s", finalName)
-	}
-}
-
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
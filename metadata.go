@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// metaDir holds a JSON sidecar per stored file under the same name, which
+// always fits where the file itself does. It is hidden, so the sidecars
+// never show up as uploads themselves.
+const metaDir = ".meta"
+
+// recordedHeaders are the request headers kept in the sidecar, mostly the
+// ones proxies add or change on the way to the server.
+var recordedHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"Transfer-Encoding",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Real-IP",
+	"Via",
+	"Referer",
+	"Origin",
+	"X-Request-ID",
+}
+
+// uploadOrigin describes who sent an upload and how, along with any tags
+// the client attached to it.
+type uploadOrigin struct {
+	Protocol  string            `json:"protocol"`
+	ClientIP  string            `json:"client_ip,omitempty"`
+	User      string            `json:"user,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+}
+
+// requestOrigin records the client of an HTTP upload. The IP is the direct
+// peer; forwarding headers are kept as sent, since they can't be trusted.
+// The user is the name of the API token, if any. Tags come from the X-Tags
+// header.
+func requestOrigin(r *http.Request, protocol string) uploadOrigin {
+	origin := uploadOrigin{Protocol: protocol, UserAgent: r.UserAgent(), Headers: map[string]string{}, Tags: parseTags(r.Header.Get("X-Tags"))}
+	origin.ClientIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if token := requestToken(r); token != nil {
+		origin.User = token.Name
+	}
+	for _, key := range recordedHeaders {
+		if value := r.Header.Get(key); value != "" {
+			origin.Headers[key] = value
+		}
+	}
+	return origin
+}
+
+// parseTags splits a comma-separated tag list.
+func parseTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// fileMeta is the sidecar record for a stored file.
+type fileMeta struct {
+	OriginalFilename string    `json:"original_filename"`
+	StoredName       string    `json:"stored_name"`
+	Size             int64     `json:"size"`
+	MimeType         string    `json:"mime_type"`
+	DetectedMimeType string    `json:"detected_mime_type,omitempty"`
+	SHA256           string    `json:"sha256,omitempty"`
+	MD5              string    `json:"md5,omitempty"`
+	CRC32C           string    `json:"crc32c,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+	uploadOrigin
+}
+
+func metaName(name string) string {
+	return metaDir + "/" + name
+}
+
+// writeMeta stores the sidecar for a successful upload. The file is
+// already in place, so a failure is only logged.
+func writeMeta(store Storage, result uploadResult, origin uploadOrigin) {
+	meta := fileMeta{
+		OriginalFilename: result.Filename,
+		StoredName:       result.StoredName,
+		Size:             result.Size,
+		MimeType:         result.MimeType,
+		DetectedMimeType: result.DetectedMimeType,
+		SHA256:           result.SHA256,
+		MD5:              result.MD5,
+		CRC32C:           result.CRC32C,
+		Timestamp:        result.Timestamp,
+		uploadOrigin:     origin,
+	}
+	if err := putMeta(store, meta); err != nil {
+		log.Printf("Failed to write metadata for %s: %v", result.StoredName, err)
+	}
+}
+
+func putMeta(store Storage, meta fileMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = store.Replace(metaName(meta.StoredName), bytes.NewReader(data))
+	return err
+}
+
+// readMeta returns the sidecar for a stored file. Files without one, such
+// as those copied into UPLOAD_DIR by hand, or whose sidecar no longer
+// matches their size report false.
+func readMeta(store Storage, info FileInfo) (fileMeta, bool) {
+	var meta fileMeta
+	rc, err := store.Get(metaName(info.Name))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read metadata for %s: %v", info.Name, err)
+		}
+		return meta, false
+	}
+	defer rc.Close()
+
+	if err := json.NewDecoder(io.LimitReader(rc, 1<<20)).Decode(&meta); err != nil {
+		log.Printf("Failed to read metadata for %s: %v", info.Name, err)
+		return meta, false
+	}
+	return meta, meta.Size == info.Size
+}
+
+// moveMeta copies the sidecar of a file that was moved from src to dst. If
+// src has none, a sidecar left over from an overwritten dst is removed.
+func moveMeta(store Storage, src, dst string) {
+	info, err := store.Stat(dst)
+	if err != nil {
+		return
+	}
+	meta, ok := readMeta(store, FileInfo{Name: src, Size: info.Size})
+	if !ok {
+		if err := store.Delete(metaName(dst)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to delete metadata for %s: %v", dst, err)
+		}
+		return
+	}
+	meta.StoredName = dst
+	if err := putMeta(store, meta); err != nil {
+		log.Printf("Failed to write metadata for %s: %v", dst, err)
+	}
+}
+
+// removeFile deletes a stored file along with its sidecar. If the file is
+// already gone it still cleans up the sidecar, and returns fs.ErrNotExist.
+func removeFile(store Storage, name string) error {
+	err := store.Delete(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := store.Delete(metaName(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to delete metadata for %s: %v", name, err)
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataSidecar(t *testing.T) {
+	store, _ := newFileStorage(t.TempDir())
+	result := uploadResult{Filename: "report final.txt", StoredName: "dir/report_final.txt", Size: 5, Timestamp: time.Now()}
+	store.Put(result.StoredName, strings.NewReader("hello"))
+	writeMeta(store, result, uploadOrigin{Protocol: "upload", ClientIP: "192.0.2.1"})
+
+	t.Run("sidecar is read back and hidden from listings", func(t *testing.T) {
+		meta, ok := readMeta(store, FileInfo{Name: result.StoredName, Size: 5})
+		if !ok {
+			t.Fatalf("Expected metadata to be found")
+		}
+		if meta.OriginalFilename != "report final.txt" || meta.ClientIP != "192.0.2.1" {
+			t.Errorf("Unexpected metadata: %+v", meta)
+		}
+		if files, _ := store.List(); len(files) != 1 {
+			t.Errorf("Expected only the upload to be listed, got %v", files)
+		}
+	})
+
+	t.Run("sidecar for a different size is ignored", func(t *testing.T) {
+		if _, ok := readMeta(store, FileInfo{Name: result.StoredName, Size: 6}); ok {
+			t.Errorf("Expected stale metadata to be ignored")
+		}
+	})
+
+	t.Run("removeFile deletes the sidecar", func(t *testing.T) {
+		if err := removeFile(store, result.StoredName); err != nil {
+			t.Fatalf("removeFile failed: %v", err)
+		}
+		if _, err := store.Stat(metaName(result.StoredName)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected sidecar to be gone, got %v", err)
+		}
+	})
+}
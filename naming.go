@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultNameTemplate gives every upload a microsecond timestamp and a
+// random suffix so concurrent uploads of the same file never collide.
+const defaultNameTemplate = "{timestamp}_{micros}_{rand}_{name}"
+
+// legacyNamePattern matches names from before NAME_TEMPLATE existed
+// ("20060102_150405_name"), so older uploads keep their metadata.
+var legacyNamePattern = regexp.MustCompile(`^(?P<timestamp>\d{8}_\d{6})_(?P<name>.+)$`)
+
+// namePlaceholders maps each template placeholder to the pattern it
+// produces, used to parse stored names back into their parts.
+var namePlaceholders = map[string]string{
+	"date":      `\d{8}`,
+	"time":      `\d{6}`,
+	"timestamp": `\d{8}_\d{6}`,
+	"micros":    `\d{6}`,
+	"rand":      `[0-9a-f]{8}`,
+	"uuid":      `[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`,
+	"name":      `.+`,
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// namer turns uploaded filenames into stored names following NAME_TEMPLATE,
+// and parses stored names back into upload time and original filename.
+type namer struct {
+	template string
+	pattern  *regexp.Regexp
+	// prefix is put in front of the sanitized filename, see prefixed
+	prefix string
+}
+
+// newNamer validates template and prepares it for parsing. {name} must
+// appear exactly once, in the last path segment.
+func newNamer(template string) (*namer, error) {
+	if strings.Count(template, "{name}") != 1 {
+		return nil, fmt.Errorf("name template %q must contain {name} exactly once", template)
+	}
+	if strings.Contains(path.Dir(template), "{name}") {
+		return nil, fmt.Errorf("name template %q must have {name} in the last path segment", template)
+	}
+	for _, segment := range strings.Split(template, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.HasPrefix(segment, ".") {
+			return nil, fmt.Errorf("name template %q has an invalid path segment %q", template, segment)
+		}
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	for _, m := range placeholderPattern.FindAllStringSubmatchIndex(template, -1) {
+		key := template[m[2]:m[3]]
+		expr, ok := namePlaceholders[key]
+		if !ok {
+			return nil, fmt.Errorf("name template %q has unknown placeholder {%s}", template, key)
+		}
+		pattern.WriteString(regexp.QuoteMeta(template[last:m[0]]))
+		if strings.Contains(pattern.String(), "(?P<"+key+">") {
+			// Repeated placeholders only need to match, not capture
+			pattern.WriteString("(?:" + expr + ")")
+		} else {
+			pattern.WriteString("(?P<" + key + ">" + expr + ")")
+		}
+		last = m[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString("$")
+
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, err
+	}
+	return &namer{template: template, pattern: re}, nil
+}
+
+// Name renders the stored name for filename uploaded at now. Each call
+// draws fresh random values, so retrying after a collision yields a new name.
+func (n *namer) Name(filename string, now time.Time) string {
+	values := map[string]string{
+		"date":      now.Format("20060102"),
+		"time":      now.Format("150405"),
+		"timestamp": now.Format("20060102_150405"),
+		"micros":    fmt.Sprintf("%06d", now.Nanosecond()/1000),
+		"rand":      randomHex(4),
+		"uuid":      newUUID(),
+	}
+
+	// The last segment, including the timestamp and suffixes, must stay
+	// within the usual 255 byte filename limit
+	rest := placeholderPattern.ReplaceAllStringFunc(path.Base(n.template), func(m string) string {
+		return values[m[1:len(m)-1]]
+	})
+	values["name"] = n.prefix + sanitizeFilenameWithMaxLen(filename, 255-len(rest)-len(n.prefix))
+
+	return placeholderPattern.ReplaceAllStringFunc(n.template, func(m string) string {
+		return values[m[1:len(m)-1]]
+	})
+}
+
+// under returns a namer that stores names below the directory prefix.
+// Parse on n still recognizes them.
+func (n *namer) under(prefix string) *namer {
+	return &namer{template: prefix + "/" + n.template, pattern: n.pattern, prefix: n.prefix}
+}
+
+// prefixed returns a namer that starts every filename with prefix, so
+// "invoice.pdf" is stored as e.g. "20250923_..._acme-invoice.pdf". Parse
+// reports the prefixed filename.
+func (n *namer) prefixed(prefix string) *namer {
+	return &namer{template: n.template, pattern: n.pattern, prefix: n.prefix + prefix}
+}
+
+// Parse extracts the upload time and original filename from a stored name.
+// The time is zero when the template doesn't record one. Names moved below
+// a directory by under are matched without that directory.
+func (n *namer) Parse(stored string) (time.Time, string, bool) {
+	for _, re := range []*regexp.Regexp{n.pattern, legacyNamePattern} {
+		m := re.FindStringSubmatch(stored)
+		for rest := stored; m == nil && strings.Contains(rest, "/"); {
+			_, rest, _ = strings.Cut(rest, "/")
+			m = re.FindStringSubmatch(rest)
+		}
+		if m == nil {
+			continue
+		}
+		parts := map[string]string{}
+		for i, key := range re.SubexpNames() {
+			if key != "" {
+				parts[key] = m[i]
+			}
+		}
+		return parseNameTime(parts), parts["name"], true
+	}
+	return time.Time{}, "", false
+}
+
+// parseNameTime rebuilds the upload time from the parsed placeholders. A
+// date alone is too coarse, so callers fall back to the modification time.
+func parseNameTime(parts map[string]string) time.Time {
+	stamp := parts["timestamp"]
+	if stamp == "" && parts["date"] != "" && parts["time"] != "" {
+		stamp = parts["date"] + "_" + parts["time"]
+	}
+	if stamp == "" {
+		return time.Time{}
+	}
+	if parts["micros"] != "" {
+		stamp += "." + parts["micros"]
+	}
+	ts, err := time.ParseInLocation("20060102_150405", stamp, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
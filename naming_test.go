@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNamer(t *testing.T) {
+	now := time.Date(2025, 9, 23, 14, 30, 22, 123456789, time.Local)
+
+	templates := []struct {
+		template string
+		pattern  string
+		wantTime time.Time
+	}{
+		{defaultNameTemplate, `^20250923_143022_123456_[0-9a-f]{8}_my_file.txt$`, now.Truncate(time.Microsecond)},
+		{"{date}/{uuid}_{name}", `^20250923/[0-9a-f-]{36}_my_file.txt$`, time.Time{}},
+		{"{date}/{time}-{rand}-{name}", `^20250923/143022-[0-9a-f]{8}-my_file.txt$`, now.Truncate(time.Second)},
+	}
+
+	for _, tc := range templates {
+		t.Run(tc.template, func(t *testing.T) {
+			names, err := newNamer(tc.template)
+			if err != nil {
+				t.Fatalf("newNamer failed: %v", err)
+			}
+
+			stored := names.Name("my file.txt", now)
+			if !regexp.MustCompile(tc.pattern).MatchString(stored) {
+				t.Fatalf("Stored name %q does not match %s", stored, tc.pattern)
+			}
+			if other := names.Name("my file.txt", now); other == stored {
+				t.Errorf("Expected a different name on retry, got %q twice", stored)
+			}
+
+			ts, original, ok := names.Parse(stored)
+			if !ok {
+				t.Fatalf("Failed to parse %q", stored)
+			}
+			if original != "my_file.txt" {
+				t.Errorf("Expected original name 'my_file.txt', got %q", original)
+			}
+			if !ts.Equal(tc.wantTime) {
+				t.Errorf("Expected time %v, got %v", tc.wantTime, ts)
+			}
+		})
+	}
+
+	t.Run("legacy names still parse", func(t *testing.T) {
+		names, _ := newNamer(defaultNameTemplate)
+		ts, original, ok := names.Parse("20250923_143022_report.pdf")
+		if !ok || original != "report.pdf" || !ts.Equal(time.Date(2025, 9, 23, 14, 30, 22, 0, time.Local)) {
+			t.Errorf("Unexpected parse result: %v %q %v", ts, original, ok)
+		}
+	})
+
+	t.Run("long filenames keep the last segment within 255 bytes", func(t *testing.T) {
+		names, _ := newNamer(defaultNameTemplate)
+		long := string(make([]byte, 300)) + ".txt"
+		if stored := names.Name(long, now); len(stored) > 255 {
+			t.Errorf("Expected at most 255 bytes, got %d", len(stored))
+		}
+	})
+
+	t.Run("filename prefix", func(t *testing.T) {
+		names, _ := newNamer("{date}/{uuid}_{name}")
+		stored := names.prefixed("acme-").Name("invoice.pdf", now)
+		if !strings.HasPrefix(stored, "20250923/") || !strings.HasSuffix(stored, "_acme-invoice.pdf") {
+			t.Errorf("Expected the prefix in front of the filename, got %q", stored)
+		}
+		if _, original, ok := names.Parse(stored); !ok || original != "acme-invoice.pdf" {
+			t.Errorf("Expected the prefixed filename to parse, got %q %v", original, ok)
+		}
+		long := names.prefixed("acme-").Name(strings.Repeat("x", 300)+".txt", now)
+		if len(path.Base(long)) > 255 || !strings.Contains(long, "_acme-x") {
+			t.Errorf("Expected the prefix kept within 255 bytes, got %d bytes", len(path.Base(long)))
+		}
+	})
+
+	t.Run("invalid templates are rejected", func(t *testing.T) {
+		for _, template := range []string{"{timestamp}", "{name}_{name}", "{name}/{date}", "../{name}", "{date}//{name}", "{nope}_{name}"} {
+			if _, err := newNamer(template); err == nil {
+				t.Errorf("Expected error for template %q", template)
+			}
+		}
+	})
+}
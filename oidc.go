@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMaxAge is how long fetched keys are used before they are reloaded
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh limits reloads for tokens signed with an unknown key
+	jwksMinRefresh = time.Minute
+	// jwtLeeway allows for clock skew between the server and the issuer
+	jwtLeeway = time.Minute
+)
+
+// oidcConfig holds the OIDC_* settings. JWT authentication is off unless a
+// JWKS URL or file is set.
+type oidcConfig struct {
+	JWKSURL     string
+	JWKSFile    string
+	Issuer      string
+	Audience    string
+	ScopesClaim string
+	ScopeMap    string
+}
+
+func oidcConfigFromEnv() oidcConfig {
+	return oidcConfig{
+		JWKSURL:     getEnv("OIDC_JWKS_URL", ""),
+		JWKSFile:    getEnv("OIDC_JWKS_FILE", ""),
+		Issuer:      getEnv("OIDC_ISSUER", ""),
+		Audience:    getEnv("OIDC_AUDIENCE", ""),
+		ScopesClaim: getEnv("OIDC_SCOPES_CLAIM", "scope"),
+		ScopeMap:    getEnv("OIDC_SCOPE_MAP", ""),
+	}
+}
+
+// jwtVerifier accepts RS256 and ES256 JWTs signed by a key in a JWKS and
+// turns them into tokens named after their subject.
+type jwtVerifier struct {
+	issuer      string
+	audience    string
+	scopesClaim []string
+	// scopeMap maps claim values to scopes; without it, claim values that
+	// name a scope are taken as is
+	scopeMap map[string][]string
+	keys     *jwks
+}
+
+// newJWTVerifier loads the key set named by cfg. It returns nil when no
+// key set is configured.
+func newJWTVerifier(cfg oidcConfig) (*jwtVerifier, error) {
+	if cfg.JWKSURL == "" && cfg.JWKSFile == "" {
+		return nil, nil
+	}
+	if cfg.JWKSURL != "" && cfg.JWKSFile != "" {
+		return nil, errors.New("set OIDC_JWKS_URL or OIDC_JWKS_FILE, not both")
+	}
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("OIDC_ISSUER and OIDC_AUDIENCE are required")
+	}
+
+	v := &jwtVerifier{
+		issuer:      cfg.Issuer,
+		audience:    cfg.Audience,
+		scopesClaim: strings.Split(cfg.ScopesClaim, "."),
+		keys:        &jwks{source: cfg.JWKSFile, load: readJWKSFile(cfg.JWKSFile)},
+	}
+	if cfg.JWKSURL != "" {
+		v.keys = &jwks{source: cfg.JWKSURL, load: fetchJWKS(cfg.JWKSURL)}
+	}
+	if cfg.ScopeMap != "" {
+		v.scopeMap = map[string][]string{}
+		for _, entry := range strings.Split(cfg.ScopeMap, ";") {
+			value, scopes, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("OIDC_SCOPE_MAP: expected claim=scope[,scope], got %q", entry)
+			}
+			for _, scope := range splitList(scopes) {
+				if !slices.Contains(knownScopes, scope) {
+					return nil, fmt.Errorf("OIDC_SCOPE_MAP: unknown scope %q", scope)
+				}
+				v.scopeMap[value] = append(v.scopeMap[value], scope)
+			}
+		}
+	}
+	if err := v.keys.reload(); err != nil {
+		return nil, fmt.Errorf("loading %s: %w", v.keys.source, err)
+	}
+	return v, nil
+}
+
+// jwtClaims are the registered claims that are checked, plus all claims
+// for the scope lookup.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	all       map[string]any
+}
+
+// verify checks the signature, issuer, audience and validity period of a
+// compact JWT.
+func (v *jwtVerifier) verify(raw string) (*apiToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, key := range v.keys.find(header.Kid, header.Alg) {
+		if verified = verifySignature(key, digest[:], sig); verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature or unknown key")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	if err := decodeSegment(parts[1], &claims.all); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.ExpiresAt == nil:
+		return nil, errors.New("no expiry")
+	case now.After(unixTime(*claims.ExpiresAt).Add(jwtLeeway)):
+		return nil, errors.New("expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)):
+		return nil, errors.New("not valid yet")
+	case claims.Issuer != v.issuer:
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case !hasAudience(claims.Audience, v.audience):
+		return nil, errors.New("not issued for this audience")
+	case claims.Subject == "":
+		return nil, errors.New("no subject")
+	}
+	return &apiToken{Name: claims.Subject, Scopes: v.scopes(claims.all)}, nil
+}
+
+// scopes maps the values of the scopes claim, a space-separated string or
+// a list of strings, to token scopes.
+func (v *jwtVerifier) scopes(claims map[string]any) []string {
+	var claim any = claims
+	for _, key := range v.scopesClaim {
+		object, _ := claim.(map[string]any)
+		claim = object[key]
+	}
+	var values []string
+	switch c := claim.(type) {
+	case string:
+		values = strings.Fields(c)
+	case []any:
+		for _, item := range c {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var scopes []string
+	for _, value := range values {
+		if v.scopeMap != nil {
+			scopes = append(scopes, v.scopeMap[value]...)
+		} else if slices.Contains(knownScopes, value) {
+			scopes = append(scopes, value)
+		}
+	}
+	return scopes
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// hasAudience reports whether aud, a string or list of strings, contains
+// audience.
+func hasAudience(aud json.RawMessage, audience string) bool {
+	var list []string
+	if err := json.Unmarshal(aud, &list); err != nil {
+		var single string
+		if json.Unmarshal(aud, &single) != nil {
+			return false
+		}
+		list = []string{single}
+	}
+	return slices.Contains(list, audience)
+}
+
+func verifySignature(key crypto.PublicKey, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS signatures are the fixed-size r and s, not ASN.1
+		if len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// jwks is a JSON Web Key Set, reloaded from its source when it gets old or
+// a token names a key it doesn't have.
+type jwks struct {
+	source string
+	load   func() ([]byte, error)
+
+	mu     sync.Mutex
+	keys   []jwk
+	loaded time.Time
+}
+
+type jwk struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+func readJWKSFile(path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return os.ReadFile(path)
+	}
+}
+
+func fetchJWKS(url string) func() ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func() ([]byte, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	}
+}
+
+// find returns the keys that may have signed a token with the given key ID
+// and algorithm. A reload for an unknown key happens at most once per
+// jwksMinRefresh, and runs without holding mu so lookups of known keys
+// aren't held up by a slow source meanwhile.
+func (s *jwks) find(kid, alg string) []crypto.PublicKey {
+	s.mu.Lock()
+	keys := s.match(kid, alg)
+	age := time.Since(s.loaded)
+	stale := age > jwksMaxAge || (len(keys) == 0 && age > jwksMinRefresh)
+	if stale {
+		// Claim the reload, so concurrent lookups don't start their own
+		s.loaded = time.Now()
+	}
+	s.mu.Unlock()
+	if !stale {
+		return keys
+	}
+
+	// Keep using the old keys if the reload fails
+	if err := s.fetch(); err != nil {
+		log.Printf("Failed to reload JWKS from %s: %v", s.source, err)
+		return keys
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.match(kid, alg)
+}
+
+func (s *jwks) match(kid, alg string) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+	for _, k := range s.keys {
+		if kid != "" && k.kid != kid || k.alg != "" && k.alg != alg {
+			continue
+		}
+		if _, ok := k.key.(*rsa.PublicKey); ok == (alg == "RS256") {
+			keys = append(keys, k.key)
+		}
+	}
+	return keys
+}
+
+func (s *jwks) reload() error {
+	s.mu.Lock()
+	s.loaded = time.Now()
+	s.mu.Unlock()
+	return s.fetch()
+}
+
+// fetch loads and parses the key set without holding mu, then swaps it in.
+func (s *jwks) fetch() error {
+	data, err := s.load()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// parseJWKS reads the RSA and P-256 signing keys from a key set, skipping
+// any others.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key := jwk{kid: k.Kid, alg: k.Alg}
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("key %q: malformed RSA key", k.Kid)
+			}
+			pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			if pub.N.BitLen() < 2048 {
+				return nil, fmt.Errorf("key %q: RSA keys must be at least 2048 bits", k.Kid)
+			}
+			key.key = pub
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+				return nil, fmt.Errorf("key %q: malformed EC key", k.Kid)
+			}
+			// Rejects points that aren't on the curve
+			point := bytes.Join([][]byte{{4}, x, y}, nil)
+			if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			key.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable RS256 or ES256 keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSigner signs JWTs with a locally generated key and describes the key
+// as a JWK.
+type testSigner struct {
+	kid string
+	key crypto.Signer
+}
+
+func (s testSigner) alg() string {
+	if _, ok := s.key.(*rsa.PrivateKey); ok {
+		return "RS256"
+	}
+	return "ES256"
+}
+
+func (s testSigner) jwk() map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PrivateKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": b64(k.X.FillBytes(make([]byte, 32))), "y": b64(k.Y.FillBytes(make([]byte, 32)))}
+	}
+	return nil
+}
+
+func (s testSigner) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": s.alg(), "typ": "JWT", "kid": s.kid})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, ss, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatalf("Signing failed: %v", err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJWKS(t *testing.T, path string, signers ...testSigner) {
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rs := testSigner{"rsa-1", rsaKey}
+	es := testSigner{"ec-1", ecKey}
+	stranger := testSigner{"ec-1", otherKey}
+
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksPath, rs, es)
+	v, err := newJWTVerifier(oidcConfig{JWKSFile: jwksPath, Issuer: "https://idp.example", Audience: "file-upload", ScopesClaim: "scope"})
+	if err != nil {
+		t.Fatalf("newJWTVerifier failed: %v", err)
+	}
+
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   "https://idp.example",
+			"aud":   []string{"other", "file-upload"},
+			"sub":   "alice",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"scope": "openid upload list",
+		}
+		for k, value := range changes {
+			if value == nil {
+				delete(c, k)
+			} else {
+				c[k] = value
+			}
+		}
+		return c
+	}
+
+	for _, s := range []testSigner{rs, es} {
+		t.Run(s.alg(), func(t *testing.T) {
+			token, err := v.verify(s.sign(t, claims(nil)))
+			if err != nil {
+				t.Fatalf("Expected valid token, got %v", err)
+			}
+			if token.Name != "alice" || !token.has(scopeUpload) || !token.has(scopeList) || token.has(scopeDelete) {
+				t.Errorf("Unexpected token: %+v", token)
+			}
+		})
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", es.sign(t, claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}))},
+		{"no expiry", es.sign(t, claims(map[string]any{"exp": nil}))},
+		{"not valid yet", es.sign(t, claims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()}))},
+		{"wrong issuer", es.sign(t, claims(map[string]any{"iss": "https://evil.example"}))},
+		{"wrong audience", es.sign(t, claims(map[string]any{"aud": "other"}))},
+		{"no subject", es.sign(t, claims(map[string]any{"sub": nil}))},
+		{"unknown key", stranger.sign(t, claims(nil))},
+		{"tampered", es.sign(t, claims(nil))[:20] + "x" + es.sign(t, claims(nil))[21:]},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + strings.Split(es.sign(t, claims(nil)), ".")[1] + "."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if token, err := v.verify(tt.token); err == nil {
+				t.Errorf("Expected rejection, got %+v", token)
+			}
+		})
+	}
+
+	t.Run("scope map on a nested claim", func(t *testing.T) {
+		mapped, err := newJWTVerifier(oidcConfig{
+			JWKSFile: jwksPath, Issuer: "https://idp.example", Audience: "file-upload",
+			ScopesClaim: "realm_access.roles", ScopeMap: "uploaders=upload,list; file-admins=admin",
+		})
+		if err != nil {
+			t.Fatalf("newJWTVerifier failed: %v", err)
+		}
+		token, err := mapped.verify(es.sign(t, claims(map[string]any{
+			"scope":        "delete",
+			"realm_access": map[string]any{"roles": []string{"uploaders", "admin"}},
+		})))
+		if err != nil {
+			t.Fatalf("Expected valid token, got %v", err)
+		}
+		if !token.has(scopeUpload) || token.has(scopeDelete) {
+			t.Errorf("Expected only mapped scopes, got %v", token.Scopes)
+		}
+	})
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	current := testSigner{"old", oldKey}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{current.jwk()}})
+	}))
+	defer srv.Close()
+
+	v, err := newJWTVerifier(oidcConfig{JWKSURL: srv.URL, Issuer: "iss", Audience: "aud", ScopesClaim: "scope"})
+	if err != nil {
+		t.Fatalf("newJWTVerifier failed: %v", err)
+	}
+	claims := map[string]any{"iss": "iss", "aud": "aud", "sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}
+
+	// The issuer rotates its key; a token with the new kid triggers a reload
+	// once the keys are old enough
+	current = testSigner{"new", newKey}
+	if _, err := v.verify(current.sign(t, claims)); err == nil {
+		t.Fatalf("Expected the new key to be unknown right after loading")
+	}
+	v.keys.loaded = time.Now().Add(-2 * jwksMinRefresh)
+	if _, err := v.verify(current.sign(t, claims)); err != nil {
+		t.Errorf("Expected the rotated key to be fetched, got %v", err)
+	}
+	if fetches != 2 {
+		t.Errorf("Expected 2 fetches, got %d", fetches)
+	}
+}
+
+func TestJWKSReloadDoesNotBlock(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]string{testSigner{"known", key}.jwk()}})
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	keys := &jwks{source: "test", load: func() ([]byte, error) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		return data, nil
+	}}
+	if err := keys.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	// A token with an unknown kid reloads the keys from a source that hangs
+	keys.loaded = time.Now().Add(-2 * jwksMinRefresh)
+	done := make(chan struct{})
+	go func() {
+		keys.find("unknown", "ES256")
+		close(done)
+	}()
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	found := make(chan int)
+	go func() { found <- len(keys.find("known", "ES256")) }()
+	select {
+	case n := <-found:
+		if n != 1 {
+			t.Errorf("Expected the known key, got %d keys", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a known key to be found while the reload hangs")
+	}
+	if keys.find("other", "ES256") != nil || fetches.Load() != 2 {
+		t.Errorf("Expected no second reload while one is running, got %d fetches", fetches.Load())
+	}
+	close(release)
+	<-done
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer := testSigner{"k", key}
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksPath, signer)
+	v, _ := newJWTVerifier(oidcConfig{JWKSFile: jwksPath, Issuer: "iss", Audience: "aud", ScopesClaim: "scope"})
+	a := &authenticator{jwt: v}
+
+	store, _ := newFileStorage(t.TempDir())
+	names, _ := newNamer(defaultNameTemplate)
+	handler := a.middleware(uploadHandler(store, names, nil, nil, 1<<20))
+
+	upload := func(scope string) *httptest.ResponseRecorder {
+		jwt := signer.sign(t, map[string]any{"iss": "iss", "aud": "aud", "sub": "carol", "exp": time.Now().Add(time.Hour).Unix(), "scope": scope})
+		r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("hello"))
+		r.Header.Set("Authorization", "Bearer "+jwt)
+		r.Header.Set("X-Filename", "notes.txt")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := upload("list"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without the upload scope, got %d", w.Code)
+	}
+	if w := upload("upload"); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	files, _ := store.List()
+	info, _ := store.Stat(files[0].Name)
+	if meta, _ := readMeta(store, info); meta.User != "carol" {
+		t.Errorf("Expected subject carol in metadata, got '%s'", meta.User)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiError is the structured error returned to clients that accept JSON.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes returned in apiError.Code.
+const (
+	codeMethodNotAllowed = "method_not_allowed"
+	codeInvalidRequest   = "invalid_request"
+	codeInvalidFilename  = "invalid_filename"
+	codeNoFile           = "no_file"
+	codeFileTooLarge     = "file_too_large"
+	codeNotFound         = "not_found"
+	codeConflict         = "conflict"
+	codeStorageError     = "storage_error"
+
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeChecksumMismatch     = "checksum_mismatch"
+	codeUnsupportedMediaType = "unsupported_media_type"
+)
+
+// wantsJSON reports whether the client explicitly accepts application/json.
+// Wildcards don't count, so curl and browsers keep getting plain text.
+func wantsJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || mediaType != "application/json" {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError replies with a plain text error, or a JSON error object with a
+// machine-readable code when the client asked for JSON.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if wantsJSON(r) {
+		writeJSON(w, status, map[string]apiError{"error": {Code: code, Message: message}})
+		return
+	}
+	http.Error(w, message, status)
+}
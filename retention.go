@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a file is removed by the retention janitor, used as metric
+// labels.
+const (
+	reasonAge   = "age"
+	reasonSize  = "size"
+	reasonCount = "count"
+)
+
+var retentionReasons = []string{reasonAge, reasonSize, reasonCount}
+
+// retentionConfig is the retention policy as set in the environment. All
+// limits are off when empty.
+type retentionConfig struct {
+	MaxAge   string
+	MaxSize  string
+	MaxFiles string
+	Interval string
+	DryRun   string
+}
+
+func retentionConfigFromEnv() retentionConfig {
+	return retentionConfig{
+		MaxAge:   getEnv("RETENTION_MAX_AGE", ""),
+		MaxSize:  getEnv("RETENTION_MAX_SIZE", ""),
+		MaxFiles: getEnv("RETENTION_MAX_FILES", ""),
+		Interval: getEnv("RETENTION_INTERVAL", "1h"),
+		DryRun:   getEnv("RETENTION_DRY_RUN", "false"),
+	}
+}
+
+// janitor periodically deletes stored files, oldest first, until they are
+// within the retention limits. Files are ordered by the timestamp in their
+// name, as in the listing, and deleted through removeFile so sidecars and
+// the index go with them.
+type janitor struct {
+	maxAge   time.Duration
+	maxBytes int64
+	maxFiles int
+	interval time.Duration
+	dryRun   bool
+
+	store Storage
+	index *metaIndex
+
+	// mu guards metrics and keeps sweeps from overlapping
+	mu      sync.Mutex
+	metrics retentionMetrics
+}
+
+// retentionMetrics counts what the janitor did since startup.
+type retentionMetrics struct {
+	runs         int64
+	failedRuns   int64
+	deleteErrors int64
+	files        map[string]int64 // by reason
+	bytes        map[string]int64 // by reason
+	lastRun      time.Time
+	storedFiles  int
+	storedBytes  int64
+}
+
+// newJanitor returns nil if no retention limit is set.
+func newJanitor(cfg retentionConfig, store Storage, index *metaIndex) (*janitor, error) {
+	j := &janitor{store: store, index: index}
+	var err error
+	if cfg.MaxAge != "" {
+		if j.maxAge, err = parseAge(cfg.MaxAge); err != nil || j.maxAge <= 0 {
+			return nil, fmt.Errorf("invalid RETENTION_MAX_AGE %q (e.g. 30d or 720h)", cfg.MaxAge)
+		}
+	}
+	if cfg.MaxSize != "" {
+		mb, err := strconv.ParseInt(cfg.MaxSize, 10, 64)
+		if err != nil || mb <= 0 {
+			return nil, fmt.Errorf("invalid RETENTION_MAX_SIZE %q (megabytes)", cfg.MaxSize)
+		}
+		j.maxBytes = mb * 1024 * 1024
+	}
+	if cfg.MaxFiles != "" {
+		if j.maxFiles, err = strconv.Atoi(cfg.MaxFiles); err != nil || j.maxFiles <= 0 {
+			return nil, fmt.Errorf("invalid RETENTION_MAX_FILES %q", cfg.MaxFiles)
+		}
+	}
+	if j.maxAge == 0 && j.maxBytes == 0 && j.maxFiles == 0 {
+		return nil, nil
+	}
+	if j.interval, err = time.ParseDuration(cfg.Interval); err != nil || j.interval <= 0 {
+		return nil, fmt.Errorf("invalid RETENTION_INTERVAL %q", cfg.Interval)
+	}
+	if j.dryRun, err = strconv.ParseBool(cfg.DryRun); err != nil {
+		return nil, fmt.Errorf("invalid RETENTION_DRY_RUN %q", cfg.DryRun)
+	}
+	j.metrics = retentionMetrics{files: map[string]int64{}, bytes: map[string]int64{}}
+	return j, nil
+}
+
+// parseAge is time.ParseDuration with a "d" suffix for whole days.
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, errors.New("invalid number of days")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func (j *janitor) String() string {
+	var limits []string
+	if j.maxAge > 0 {
+		limits = append(limits, "max age "+j.maxAge.String())
+	}
+	if j.maxBytes > 0 {
+		limits = append(limits, fmt.Sprintf("max size %d MB", j.maxBytes/1024/1024))
+	}
+	if j.maxFiles > 0 {
+		limits = append(limits, fmt.Sprintf("max %d files", j.maxFiles))
+	}
+	s := strings.Join(limits, ", ") + ", every " + j.interval.String()
+	if j.dryRun {
+		s += " (dry run)"
+	}
+	return s
+}
+
+// run sweeps right away and then every interval. It never returns.
+func (j *janitor) run() {
+	for {
+		j.sweep(time.Now())
+		time.Sleep(j.interval)
+	}
+}
+
+// sweep deletes the files over the limits at now, or in dry-run mode only
+// logs them, and returns how many it deleted.
+func (j *janitor) sweep(now time.Time) int {
+	entries, err := j.index.query(fileFilter{})
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.metrics.runs++
+	j.metrics.lastRun = now
+	if err != nil {
+		log.Printf("Failed to list files for retention: %v", err)
+		j.metrics.failedRuns++
+		return 0
+	}
+
+	// files and bytes are what would remain, stored what actually does
+	files, bytes := len(entries), int64(0)
+	for _, entry := range entries {
+		bytes += entry.Size
+	}
+	storedFiles, storedBytes := files, bytes
+	deleted := 0
+	// Entries are oldest first, so once the oldest remaining file breaks no
+	// limit, none of the newer ones do either
+	for _, entry := range entries {
+		reason := ""
+		switch {
+		case j.maxAge > 0 && now.Sub(entry.Timestamp) > j.maxAge:
+			reason = reasonAge
+		case j.maxFiles > 0 && files > j.maxFiles:
+			reason = reasonCount
+		case j.maxBytes > 0 && bytes > j.maxBytes:
+			reason = reasonSize
+		}
+		if reason == "" {
+			break
+		}
+
+		if j.dryRun {
+			log.Printf("Retention dry run: would delete %s (%s, %d bytes, %s)", entry.StoredName, reason, entry.Size, entry.Timestamp.Format(time.RFC3339))
+		} else {
+			err := removeFile(j.store, entry.StoredName)
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				// Deleted out of band, so it only has to leave the index
+				log.Printf("Retention found %s already deleted", entry.StoredName)
+				if err := j.index.remove(entry.StoredName); err != nil {
+					log.Printf("Failed to update index for %s: %v", entry.StoredName, err)
+				}
+			case err != nil:
+				log.Printf("Failed to delete %s for retention: %v", entry.StoredName, err)
+				j.metrics.deleteErrors++
+				continue
+			default:
+				log.Printf("Retention deleted %s (%s, %d bytes)", entry.StoredName, reason, entry.Size)
+				j.metrics.files[reason]++
+				j.metrics.bytes[reason] += entry.Size
+				deleted++
+			}
+			storedFiles--
+			storedBytes -= entry.Size
+		}
+		files--
+		bytes -= entry.Size
+	}
+
+	j.metrics.storedFiles = storedFiles
+	j.metrics.storedBytes = storedBytes
+	if deleted > 0 {
+		log.Printf("Retention deleted %d file(s), %d remain (%d bytes)", deleted, storedFiles, storedBytes)
+	}
+	return deleted
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text format. With
+// retention off it only reports that.
+func (j *janitor) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("file_upload_retention_enabled", "gauge", "Whether a retention policy is configured.")
+	if j == nil {
+		fmt.Fprintln(w, "file_upload_retention_enabled 0")
+		return
+	}
+	fmt.Fprintln(w, "file_upload_retention_enabled 1")
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	m := j.metrics
+	dryRun := 0
+	if j.dryRun {
+		dryRun = 1
+	}
+	metric("file_upload_retention_dry_run", "gauge", "Whether the janitor only logs what it would delete.")
+	fmt.Fprintf(w, "file_upload_retention_dry_run %d\n", dryRun)
+	metric("file_upload_retention_runs_total", "counter", "Retention sweeps run.")
+	fmt.Fprintf(w, "file_upload_retention_runs_total %d\n", m.runs)
+	metric("file_upload_retention_failed_runs_total", "counter", "Retention sweeps that could not list the files.")
+	fmt.Fprintf(w, "file_upload_retention_failed_runs_total %d\n", m.failedRuns)
+	metric("file_upload_retention_delete_errors_total", "counter", "Files the janitor failed to delete.")
+	fmt.Fprintf(w, "file_upload_retention_delete_errors_total %d\n", m.deleteErrors)
+	metric("file_upload_retention_deleted_files_total", "counter", "Files deleted by the janitor, by the limit they broke.")
+	for _, reason := range retentionReasons {
+		fmt.Fprintf(w, "file_upload_retention_deleted_files_total{reason=%q} %d\n", reason, m.files[reason])
+	}
+	metric("file_upload_retention_deleted_bytes_total", "counter", "Bytes deleted by the janitor, by the limit they broke.")
+	for _, reason := range retentionReasons {
+		fmt.Fprintf(w, "file_upload_retention_deleted_bytes_total{reason=%q} %d\n", reason, m.bytes[reason])
+	}
+	if !m.lastRun.IsZero() {
+		metric("file_upload_retention_last_run_timestamp_seconds", "gauge", "Time of the last retention sweep.")
+		fmt.Fprintf(w, "file_upload_retention_last_run_timestamp_seconds %d\n", m.lastRun.Unix())
+		metric("file_upload_stored_files", "gauge", "Stored files after the last retention sweep.")
+		fmt.Fprintf(w, "file_upload_stored_files %d\n", m.storedFiles)
+		metric("file_upload_stored_bytes", "gauge", "Bytes stored after the last retention sweep.")
+		fmt.Fprintf(w, "file_upload_stored_bytes %d\n", m.storedBytes)
+	}
+}
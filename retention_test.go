@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewJanitor(t *testing.T) {
+	if j, err := newJanitor(retentionConfig{Interval: "1h", DryRun: "false"}, nil, nil); j != nil || err != nil {
+		t.Errorf("Expected no janitor without limits, got %v, %v", j, err)
+	}
+	j, err := newJanitor(retentionConfig{MaxAge: "30d", MaxSize: "512", MaxFiles: "1000", Interval: "10m", DryRun: "true"}, nil, nil)
+	if err != nil {
+		t.Fatalf("newJanitor failed: %v", err)
+	}
+	if j.maxAge != 30*24*time.Hour || j.maxBytes != 512<<20 || j.maxFiles != 1000 || j.interval != 10*time.Minute || !j.dryRun {
+		t.Errorf("Unexpected janitor: %+v", j)
+	}
+	for _, cfg := range []retentionConfig{
+		{MaxAge: "30 days", Interval: "1h", DryRun: "false"},
+		{MaxSize: "-1", Interval: "1h", DryRun: "false"},
+		{MaxFiles: "many", Interval: "1h", DryRun: "false"},
+		{MaxFiles: "10", Interval: "0s", DryRun: "false"},
+		{MaxFiles: "10", Interval: "1h", DryRun: "maybe"},
+	} {
+		if _, err := newJanitor(cfg, nil, nil); err == nil {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestJanitorSweep(t *testing.T) {
+	dir := t.TempDir()
+	names, _ := newNamer(defaultNameTemplate)
+	base, _ := newFileStorage(filepath.Join(dir, "uploads"))
+	store, err := newIndexedStorage(base, names, filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatalf("newIndexedStorage failed: %v", err)
+	}
+	defer store.index.Close()
+
+	// One 10-byte file on the first of each month, January to May
+	var stored []string
+	for month := 1; month <= 5; month++ {
+		name := time.Date(2025, time.Month(month), 1, 12, 0, 0, 0, time.Local).Format("20060102_150405") + "_000000_aaaaaaaa_file.txt"
+		store.Put(name, strings.NewReader("0123456789"))
+		stored = append(stored, name)
+	}
+	writeMeta(store, uploadResult{Filename: "file.txt", StoredName: stored[0], Size: 10}, uploadOrigin{Protocol: "upload"})
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local)
+	remaining := func() []string {
+		entries, _ := store.index.query(fileFilter{})
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.StoredName)
+		}
+		return names
+	}
+
+	j, _ := newJanitor(retentionConfig{MaxAge: "100d", MaxFiles: "2", Interval: "1h", DryRun: "true"}, store, store.index)
+
+	t.Run("dry run deletes nothing", func(t *testing.T) {
+		if deleted := j.sweep(now); deleted != 0 || len(remaining()) != 5 {
+			t.Errorf("Expected no deletions, got %d with %v left", deleted, remaining())
+		}
+	})
+
+	t.Run("oldest files go first", func(t *testing.T) {
+		// January and February are over 100 days old, March breaks the
+		// file count
+		j.dryRun = false
+		if deleted := j.sweep(now); deleted != 3 {
+			t.Errorf("Expected 3 deletions, got %d", deleted)
+		}
+		if got := remaining(); strings.Join(got, ",") != strings.Join(stored[3:], ",") {
+			t.Errorf("Expected April and May to remain, got %v", got)
+		}
+		if _, err := base.Stat(metaName(stored[0])); err == nil {
+			t.Errorf("Expected the sidecar to be deleted with its file")
+		}
+	})
+
+	t.Run("total size", func(t *testing.T) {
+		j.maxAge, j.maxFiles, j.maxBytes = 0, 0, 15
+		if deleted := j.sweep(now); deleted != 1 || len(remaining()) != 1 {
+			t.Errorf("Expected April to go, got %d deletions with %v left", deleted, remaining())
+		}
+	})
+
+	t.Run("files deleted out of band", func(t *testing.T) {
+		// May is over the limit, but already gone from storage
+		j.maxBytes = 5
+		base.Delete(stored[4])
+		if deleted := j.sweep(now); deleted != 0 || len(remaining()) != 0 {
+			t.Errorf("Expected May to leave the index without a deletion, got %d with %v left", deleted, remaining())
+		}
+		if j.metrics.deleteErrors != 0 || j.metrics.storedFiles != 0 {
+			t.Errorf("Expected no delete errors and nothing stored, got %+v", j.metrics)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		j.metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		for _, want := range []string{
+			"file_upload_retention_runs_total 4",
+			`file_upload_retention_deleted_files_total{reason="age"} 2`,
+			`file_upload_retention_deleted_files_total{reason="count"} 1`,
+			`file_upload_retention_deleted_bytes_total{reason="size"} 10`,
+			"file_upload_stored_files 0",
+		} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("Expected %q in metrics:\n%s", want, w.Body)
+			}
+		}
+
+		w = httptest.NewRecorder()
+		(*janitor)(nil).metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if !strings.Contains(w.Body.String(), "file_upload_retention_enabled 0") {
+			t.Errorf("Expected retention to be reported as off, got:\n%s", w.Body)
+		}
+	})
+}
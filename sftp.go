@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP packet types (draft-ietf-secsh-filexfer-02, protocol version 3).
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+// SFTP status codes.
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+const (
+	sftpFlagWrite = 0x2
+
+	sftpAttrSize        = 0x1
+	sftpAttrPermissions = 0x4
+	sftpAttrTimes       = 0x8
+
+	// sftpMaxPacket bounds a single request; clients write in 32 KiB pieces
+	sftpMaxPacket = 1 << 20
+
+	// sftpReaddirBatch is how many entries one READDIR returns, keeping
+	// replies well below the 256 KiB packets OpenSSH accepts
+	sftpReaddirBatch = 100
+)
+
+// sftpConfig holds the SFTP_* settings. An empty Port disables SFTP.
+type sftpConfig struct {
+	Port           string
+	HostKeyPath    string
+	User           string
+	Password       string
+	AuthorizedKeys string
+}
+
+// sftpConfigFromEnv reads the SFTP settings. The host key defaults to a
+// hidden file in uploadDir, which is already on persistent storage.
+func sftpConfigFromEnv(uploadDir string) sftpConfig {
+	return sftpConfig{
+		Port:           getEnv("SFTP_PORT", ""),
+		HostKeyPath:    getEnv("SFTP_HOST_KEY", filepath.Join(uploadDir, ".sftp", "host_key")),
+		User:           getEnv("SFTP_USER", "upload"),
+		Password:       getEnv("SFTP_PASSWORD", ""),
+		AuthorizedKeys: getEnv("SFTP_AUTHORIZED_KEYS", ""),
+	}
+}
+
+// sftpServer accepts uploads over SFTP. Files are staged in dir while they
+// are written and stored with the same naming as uploadHandler when the
+// client closes them. Only the file name is kept from the client's path.
+// Reading, deleting and renaming are not supported.
+type sftpServer struct {
+	config       *ssh.ServerConfig
+	dir          string
+	store        Storage
+	names        *namer
+	types        *typePolicy
+	maxSizeBytes int64
+}
+
+func newSFTPServer(cfg sftpConfig, dir string, store Storage, names *namer, types *typePolicy, maxSizeBytes int64) (*sftpServer, error) {
+	if cfg.Password == "" && cfg.AuthorizedKeys == "" {
+		return nil, errors.New("SFTP_PASSWORD or SFTP_AUTHORIZED_KEYS is required")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	hostKey, err := loadOrCreateHostKey(cfg.HostKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("host key: %w", err)
+	}
+
+	config := &ssh.ServerConfig{}
+	if cfg.Password != "" {
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			userOK := subtle.ConstantTimeCompare([]byte(conn.User()), []byte(cfg.User)) == 1
+			passOK := subtle.ConstantTimeCompare(password, []byte(cfg.Password)) == 1
+			if userOK && passOK {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		}
+	}
+	if cfg.AuthorizedKeys != "" {
+		keys, err := loadAuthorizedKeys(cfg.AuthorizedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("authorized keys: %w", err)
+		}
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == cfg.User && keys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		}
+	}
+	config.AddHostKey(hostKey)
+
+	return &sftpServer{config: config, dir: dir, store: store, names: names, types: types, maxSizeBytes: maxSizeBytes}, nil
+}
+
+// loadOrCreateHostKey reads the host key at keyPath, generating and saving
+// an Ed25519 key on first start so clients see the same key every time.
+func loadOrCreateHostKey(keyPath string) (ssh.Signer, error) {
+	data, err := os.ReadFile(keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, genErr := ed25519.GenerateKey(rand.Reader)
+		if genErr != nil {
+			return nil, genErr
+		}
+		der, marshalErr := x509.MarshalPKCS8PrivateKey(key)
+		if marshalErr != nil {
+			return nil, marshalErr
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyPath, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated SFTP host key: %s", keyPath)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// loadAuthorizedKeys parses an OpenSSH authorized_keys file.
+func loadAuthorizedKeys(keysPath string) (map[string]bool, error) {
+	data, err := os.ReadFile(keysPath)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+	return keys, nil
+}
+
+// Serve accepts SSH connections on l until it is closed.
+func (s *sftpServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *sftpServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.Printf("SFTP handshake failed from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	origin := uploadOrigin{Protocol: "sftp", User: sshConn.User(), UserAgent: string(sshConn.ClientVersion())}
+	origin.ClientIP, _, _ = net.SplitHostPort(sshConn.RemoteAddr().String())
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("Failed to accept SFTP channel: %v", err)
+			continue
+		}
+		go s.handleSession(channel, requests, origin)
+	}
+}
+
+// handleSession starts the sftp subsystem when asked and refuses shells,
+// commands and everything else.
+func (s *sftpServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request, origin uploadOrigin) {
+	started := false
+	for req := range requests {
+		// The payload is the subsystem name as an SSH string
+		ok := !started && req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		started = true
+		go func() {
+			session := &sftpSession{server: s, rw: channel, origin: origin, handles: map[string]*sftpHandleState{}}
+			if err := session.serve(); err != nil && err != io.EOF {
+				log.Printf("SFTP session ended: %v", err)
+			}
+			session.closeAll()
+			channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+			channel.Close()
+		}()
+	}
+	if !started {
+		channel.Close()
+	}
+}
+
+// sftpHandleState is an open file being uploaded, or an open directory.
+type sftpHandleState struct {
+	name   string
+	file   *os.File
+	size   int64
+	dir    bool
+	listed bool
+	// entries are the directory entries not sent yet, three fields each
+	entries [][]any
+}
+
+// sftpSession serves the SFTP protocol on one channel. Requests are
+// handled in order, so no locking is needed.
+type sftpSession struct {
+	server  *sftpServer
+	rw      io.ReadWriter
+	origin  uploadOrigin
+	handles map[string]*sftpHandleState
+	nextID  int
+}
+
+func (s *sftpSession) serve() error {
+	r := bufio.NewReader(s.rw)
+	for {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length == 0 || length > sftpMaxPacket {
+			return fmt.Errorf("invalid packet length %d", length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return err
+		}
+		if err := s.handle(packet[0], sftpBuffer(packet[1:])); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpSession) handle(kind byte, p sftpBuffer) error {
+	if kind == sftpInit {
+		return s.send(sftpVersion, uint32(3))
+	}
+	id, ok := p.uint32()
+	if !ok {
+		return errors.New("truncated request")
+	}
+
+	switch kind {
+	case sftpOpen:
+		name, ok1 := p.string()
+		flags, ok2 := p.uint32()
+		if !ok1 || !ok2 {
+			return s.status(id, sftpBadMessage, "bad message")
+		}
+		return s.open(id, name, flags)
+	case sftpWrite:
+		handle, ok1 := p.string()
+		offset, ok2 := p.uint64()
+		data, ok3 := p.string()
+		if !ok1 || !ok2 || !ok3 {
+			return s.status(id, sftpBadMessage, "bad message")
+		}
+		return s.write(id, handle, offset, []byte(data))
+	case sftpClose:
+		handle, _ := p.string()
+		return s.close(id, handle)
+	case sftpRealpath:
+		name, _ := p.string()
+		clean := path.Clean("/" + name)
+		return s.send(sftpName, id, uint32(1), clean, clean, dirAttrs(time.Now()))
+	case sftpStat, sftpLstat:
+		name, _ := p.string()
+		return s.stat(id, name)
+	case sftpFstat:
+		handle, _ := p.string()
+		h := s.handles[handle]
+		if h == nil {
+			return s.status(id, sftpFailure, "invalid handle")
+		}
+		if h.dir {
+			return s.send(sftpAttrs, id, dirAttrs(time.Now()))
+		}
+		return s.send(sftpAttrs, id, fileAttrs(h.size, time.Now()))
+	case sftpSetstat, sftpFsetstat:
+		// Permissions and times are meaningless for stored uploads
+		return s.status(id, sftpOK, "")
+	case sftpOpendir:
+		name, _ := p.string()
+		if path.Clean("/"+name) != "/" {
+			return s.status(id, sftpNoSuchFile, "no such directory")
+		}
+		return s.send(sftpHandle, id, s.addHandle(&sftpHandleState{dir: true}))
+	case sftpReaddir:
+		handle, _ := p.string()
+		return s.readdir(id, handle)
+	case sftpRead:
+		return s.status(id, sftpPermissionDenied, "downloads are not supported")
+	default:
+		return s.status(id, sftpOpUnsupported, "operation not supported")
+	}
+}
+
+// open starts an upload. The file is staged locally until CLOSE.
+func (s *sftpSession) open(id uint32, name string, flags uint32) error {
+	if hiddenPath(name) {
+		return s.status(id, sftpNoSuchFile, "no such file")
+	}
+	if flags&sftpFlagWrite == 0 {
+		return s.status(id, sftpPermissionDenied, "downloads are not supported")
+	}
+	filename := path.Base(path.Clean("/" + name))
+	if filename == "/" {
+		return s.status(id, sftpFailure, "not a file")
+	}
+	if err := s.server.types.check("", "", filename); err != nil {
+		return s.status(id, sftpPermissionDenied, err.Error())
+	}
+
+	file, err := os.CreateTemp(s.server.dir, tempPattern)
+	if err != nil {
+		log.Printf("Failed to stage SFTP upload: %v", err)
+		return s.status(id, sftpFailure, "failed to create file")
+	}
+	return s.send(sftpHandle, id, s.addHandle(&sftpHandleState{name: filename, file: file}))
+}
+
+func (s *sftpSession) write(id uint32, handle string, offset uint64, data []byte) error {
+	h := s.handles[handle]
+	if h == nil || h.file == nil {
+		return s.status(id, sftpFailure, "invalid handle")
+	}
+	end := offset + uint64(len(data))
+	if end > uint64(s.server.maxSizeBytes) {
+		return s.status(id, sftpFailure, "file too large")
+	}
+	if _, err := h.file.WriteAt(data, int64(offset)); err != nil {
+		log.Printf("Failed to write SFTP upload: %v", err)
+		return s.status(id, sftpFailure, "write failed")
+	}
+	h.size = max(h.size, int64(end))
+	return s.status(id, sftpOK, "")
+}
+
+// close finishes an upload by moving the staged file into storage.
+func (s *sftpSession) close(id uint32, handle string) error {
+	h := s.handles[handle]
+	if h == nil {
+		return s.status(id, sftpFailure, "invalid handle")
+	}
+	delete(s.handles, handle)
+	if h.dir {
+		return s.status(id, sftpOK, "")
+	}
+	defer os.Remove(h.file.Name())
+	defer h.file.Close()
+
+	if _, err := h.file.Seek(0, io.SeekStart); err != nil {
+		return s.status(id, sftpFailure, "failed to read staged file")
+	}
+	result := storeFile(s.server.store, s.server.names, s.server.types, h.name, "", newChecksumReader(h.file, nil, nil), s.origin)
+	if result.Error != nil {
+		return s.status(id, sftpFailure, result.Error.Message)
+	}
+	log.Printf("SFTP upload stored: %s", result.StoredName)
+	return s.status(id, sftpOK, "")
+}
+
+func (s *sftpSession) stat(id uint32, name string) error {
+	clean := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if clean == "" {
+		return s.send(sftpAttrs, id, dirAttrs(time.Now()))
+	}
+	if !validStoredName(clean) {
+		return s.status(id, sftpNoSuchFile, "no such file")
+	}
+	info, err := s.server.store.Stat(clean)
+	if err != nil {
+		return s.status(id, sftpNoSuchFile, "no such file")
+	}
+	return s.send(sftpAttrs, id, fileAttrs(info.Size, info.ModTime))
+}
+
+// hiddenPath reports whether name points into the server's own files, such
+// as .index.db, .meta/ or .sftp/host_key, which SFTP treats as nonexistent.
+func hiddenPath(name string) bool {
+	for _, segment := range strings.Split(path.Clean("/"+name), "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// readdir lists the top level of storage, sftpReaddirBatch entries per
+// call; nested names from NAME_TEMPLATE directories are shown as their
+// first segment.
+func (s *sftpSession) readdir(id uint32, handle string) error {
+	h := s.handles[handle]
+	if h == nil || !h.dir {
+		return s.status(id, sftpFailure, "invalid handle")
+	}
+	if !h.listed {
+		files, err := s.server.store.List()
+		if err != nil {
+			log.Printf("Failed to list files for SFTP: %v", err)
+			return s.status(id, sftpFailure, "failed to list files")
+		}
+		h.listed = true
+
+		seen := map[string]bool{}
+		for _, f := range files {
+			top, _, nested := strings.Cut(f.Name, "/")
+			if seen[top] {
+				continue
+			}
+			seen[top] = true
+			if nested {
+				h.entries = append(h.entries, []any{top, longName(top, 0, f.ModTime, true), dirAttrs(f.ModTime)})
+			} else {
+				h.entries = append(h.entries, []any{top, longName(top, f.Size, f.ModTime, false), fileAttrs(f.Size, f.ModTime)})
+			}
+		}
+	}
+	if len(h.entries) == 0 {
+		return s.status(id, sftpEOF, "")
+	}
+
+	batch := h.entries[:min(len(h.entries), sftpReaddirBatch)]
+	h.entries = h.entries[len(batch):]
+	fields := []any{id, uint32(len(batch))}
+	for _, entry := range batch {
+		fields = append(fields, entry...)
+	}
+	return s.send(sftpName, fields...)
+}
+
+func (s *sftpSession) addHandle(h *sftpHandleState) string {
+	s.nextID++
+	handle := strconv.Itoa(s.nextID)
+	s.handles[handle] = h
+	return handle
+}
+
+// closeAll discards uploads the client never closed.
+func (s *sftpSession) closeAll() {
+	for _, h := range s.handles {
+		if h.file != nil {
+			h.file.Close()
+			os.Remove(h.file.Name())
+		}
+	}
+}
+
+func (s *sftpSession) status(id uint32, code uint32, message string) error {
+	return s.send(sftpStatus, id, code, message, "")
+}
+
+// send writes one packet. Fields are encoded by type: uint32, uint64,
+// string, and pre-encoded attrs as []byte.
+func (s *sftpSession) send(kind byte, fields ...any) error {
+	var body bytes.Buffer
+	body.WriteByte(kind)
+	for _, field := range fields {
+		switch v := field.(type) {
+		case uint32:
+			binary.Write(&body, binary.BigEndian, v)
+		case uint64:
+			binary.Write(&body, binary.BigEndian, v)
+		case string:
+			binary.Write(&body, binary.BigEndian, uint32(len(v)))
+			body.WriteString(v)
+		case []byte:
+			body.Write(v)
+		}
+	}
+
+	packet := binary.BigEndian.AppendUint32(nil, uint32(body.Len()))
+	_, err := s.rw.Write(append(packet, body.Bytes()...))
+	return err
+}
+
+func fileAttrs(size int64, modTime time.Time) []byte {
+	return encodeAttrs(uint64(size), 0100644, modTime)
+}
+
+func dirAttrs(modTime time.Time) []byte {
+	return encodeAttrs(0, 040755, modTime)
+}
+
+func encodeAttrs(size uint64, mode uint32, modTime time.Time) []byte {
+	b := binary.BigEndian.AppendUint32(nil, sftpAttrSize|sftpAttrPermissions|sftpAttrTimes)
+	b = binary.BigEndian.AppendUint64(b, size)
+	b = binary.BigEndian.AppendUint32(b, mode)
+	b = binary.BigEndian.AppendUint32(b, uint32(modTime.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(modTime.Unix()))
+}
+
+// longName formats an entry the way "ls -l" would, which clients display.
+func longName(name string, size int64, modTime time.Time, dir bool) string {
+	mode := "-rw-r--r--"
+	if dir {
+		mode = "drwxr-xr-x"
+	}
+	return fmt.Sprintf("%s 1 upload upload %8d %s %s", mode, size, modTime.Format("Jan _2 15:04"), name)
+}
+
+// sftpBuffer decodes SFTP request fields in order.
+type sftpBuffer []byte
+
+func (b *sftpBuffer) uint32() (uint32, bool) {
+	if len(*b) < 4 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint32(*b)
+	*b = (*b)[4:]
+	return v, true
+}
+
+func (b *sftpBuffer) uint64() (uint64, bool) {
+	if len(*b) < 8 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint64(*b)
+	*b = (*b)[8:]
+	return v, true
+}
+
+func (b *sftpBuffer) string() (string, bool) {
+	n, ok := b.uint32()
+	if !ok || uint64(len(*b)) < uint64(n) {
+		return "", false
+	}
+	v := string((*b)[:n])
+	*b = (*b)[n:]
+	return v, true
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpTestClient speaks just enough SFTP to upload a file.
+type sftpTestClient struct {
+	t      *testing.T
+	stdin  io.Writer
+	stdout io.Reader
+	nextID uint32
+}
+
+func (c *sftpTestClient) send(kind byte, fields ...any) uint32 {
+	c.t.Helper()
+	c.nextID++
+	var body bytes.Buffer
+	body.WriteByte(kind)
+	if kind != sftpInit {
+		binary.Write(&body, binary.BigEndian, c.nextID)
+	}
+	for _, field := range fields {
+		switch v := field.(type) {
+		case uint32, uint64:
+			binary.Write(&body, binary.BigEndian, v)
+		case string:
+			binary.Write(&body, binary.BigEndian, uint32(len(v)))
+			body.WriteString(v)
+		}
+	}
+	binary.Write(c.stdin, binary.BigEndian, uint32(body.Len()))
+	if _, err := c.stdin.Write(body.Bytes()); err != nil {
+		c.t.Fatalf("Failed to send packet: %v", err)
+	}
+	return c.nextID
+}
+
+// recv reads a response and returns its type and the payload after the ID.
+func (c *sftpTestClient) recv() (byte, sftpBuffer) {
+	c.t.Helper()
+	var length uint32
+	if err := binary.Read(c.stdout, binary.BigEndian, &length); err != nil {
+		c.t.Fatalf("Failed to read packet: %v", err)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(c.stdout, packet); err != nil {
+		c.t.Fatalf("Failed to read packet: %v", err)
+	}
+	payload := sftpBuffer(packet[1:])
+	if packet[0] != sftpVersion {
+		payload.uint32()
+	}
+	return packet[0], payload
+}
+
+func (c *sftpTestClient) expectStatus(code uint32) {
+	c.t.Helper()
+	kind, payload := c.recv()
+	got, _ := payload.uint32()
+	if kind != sftpStatus || got != code {
+		message, _ := payload.string()
+		c.t.Fatalf("Expected status %d, got packet %d status %d (%s)", code, kind, got, message)
+	}
+}
+
+func startTestSFTP(t *testing.T, cfg sftpConfig, store Storage) string {
+	t.Helper()
+	names, _ := newNamer(defaultNameTemplate)
+	server, err := newSFTPServer(cfg, filepath.Join(t.TempDir(), "staging"), store, names, nil, 1024)
+	if err != nil {
+		t.Fatalf("newSFTPServer failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+func dialTestSFTP(t *testing.T, addr, password string) (*sftpTestClient, error) {
+	t.Helper()
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "upload",
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession failed: %v", err)
+	}
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("RequestSubsystem failed: %v", err)
+	}
+
+	client := &sftpTestClient{t: t, stdin: stdin, stdout: stdout}
+	client.send(sftpInit, uint32(3))
+	if kind, _ := client.recv(); kind != sftpVersion {
+		t.Fatalf("Expected VERSION, got packet %d", kind)
+	}
+	return client, nil
+}
+
+func TestSFTPServer(t *testing.T) {
+	dir := t.TempDir()
+	cfg := sftpConfig{HostKeyPath: filepath.Join(dir, "host_key"), User: "upload", Password: "secret"}
+	store, _ := newFileStorage(filepath.Join(dir, "uploads"))
+	addr := startTestSFTP(t, cfg, store)
+
+	t.Run("upload is stored with the naming template", func(t *testing.T) {
+		client, err := dialTestSFTP(t, addr, "secret")
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+
+		// WRITE|CREAT|TRUNC with empty attrs
+		client.send(sftpOpen, "/incoming/report.txt", uint32(0x2|0x8|0x10), uint32(0))
+		kind, payload := client.recv()
+		handle, _ := payload.string()
+		if kind != sftpHandle {
+			t.Fatalf("Expected HANDLE, got packet %d", kind)
+		}
+
+		// Second half first, as pipelining clients may do
+		client.send(sftpWrite, handle, uint64(6), "world")
+		client.expectStatus(sftpOK)
+		client.send(sftpWrite, handle, uint64(0), "hello ")
+		client.expectStatus(sftpOK)
+		client.send(sftpClose, handle)
+		client.expectStatus(sftpOK)
+
+		files, _ := store.List()
+		if len(files) != 1 || !strings.HasSuffix(files[0].Name, "_report.txt") {
+			t.Fatalf("Expected one stored report.txt, got %v", files)
+		}
+		rc, _ := store.Get(files[0].Name)
+		defer rc.Close()
+		if data, _ := io.ReadAll(rc); string(data) != "hello world" {
+			t.Errorf("Expected 'hello world', got '%s'", data)
+		}
+	})
+
+	t.Run("writes beyond MAX_SIZE fail", func(t *testing.T) {
+		client, _ := dialTestSFTP(t, addr, "secret")
+		client.send(sftpOpen, "big.bin", uint32(0x2|0x8), uint32(0))
+		_, payload := client.recv()
+		handle, _ := payload.string()
+
+		client.send(sftpWrite, handle, uint64(1000), strings.Repeat("x", 100))
+		client.expectStatus(sftpFailure)
+	})
+
+	t.Run("reading is refused", func(t *testing.T) {
+		client, _ := dialTestSFTP(t, addr, "secret")
+		client.send(sftpOpen, "anything.txt", uint32(0x1), uint32(0))
+		client.expectStatus(sftpPermissionDenied)
+	})
+
+	t.Run("internal files are hidden", func(t *testing.T) {
+		store.Put(".index.db", strings.NewReader("index"))
+		store.Put(".meta/report.txt.json", strings.NewReader("{}"))
+		client, _ := dialTestSFTP(t, addr, "secret")
+		for _, name := range []string{"/.index.db", ".meta/report.txt.json", "/incoming/../.sftp/host_key"} {
+			client.send(sftpStat, name)
+			client.expectStatus(sftpNoSuchFile)
+			client.send(sftpLstat, name)
+			client.expectStatus(sftpNoSuchFile)
+			client.send(sftpOpen, name, uint32(0x1), uint32(0))
+			client.expectStatus(sftpNoSuchFile)
+			client.send(sftpOpen, name, uint32(0x2|0x8), uint32(0))
+			client.expectStatus(sftpNoSuchFile)
+		}
+	})
+
+	t.Run("large directories are listed in batches", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := newFileStorage(filepath.Join(dir, "uploads"))
+		for i := 0; i < 250; i++ {
+			store.Put(fmt.Sprintf("file%03d.txt", i), strings.NewReader("x"))
+		}
+		client, _ := dialTestSFTP(t, startTestSFTP(t, sftpConfig{HostKeyPath: filepath.Join(dir, "host_key"), User: "upload", Password: "secret"}, store), "secret")
+		client.send(sftpOpendir, "/")
+		_, payload := client.recv()
+		handle, _ := payload.string()
+
+		var batches []uint32
+		for {
+			client.send(sftpReaddir, handle)
+			kind, payload := client.recv()
+			if kind == sftpStatus {
+				if code, _ := payload.uint32(); code != sftpEOF {
+					t.Fatalf("Expected EOF, got status %d", code)
+				}
+				break
+			}
+			count, _ := payload.uint32()
+			batches = append(batches, count)
+		}
+		if fmt.Sprint(batches) != "[100 100 50]" {
+			t.Errorf("Expected batches of 100, got %v", batches)
+		}
+	})
+
+	t.Run("wrong password is rejected", func(t *testing.T) {
+		if _, err := dialTestSFTP(t, addr, "wrong"); err == nil {
+			t.Errorf("Expected authentication to fail")
+		}
+	})
+
+	t.Run("host key persists across restarts", func(t *testing.T) {
+		first, err := loadOrCreateHostKey(cfg.HostKeyPath)
+		if err != nil {
+			t.Fatalf("loadOrCreateHostKey failed: %v", err)
+		}
+		second, _ := loadOrCreateHostKey(cfg.HostKeyPath)
+		if !bytes.Equal(first.PublicKey().Marshal(), second.PublicKey().Marshal()) {
+			t.Errorf("Expected the same host key after reloading")
+		}
+	})
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultShareExpiry is how long a download share is valid unless its
+// creator asks otherwise.
+const defaultShareExpiry = 7 * 24 * time.Hour
+
+// share is the persisted state of a download link to one stored file. The
+// link is /s/{id}; the random ID is the only secret unless a password is
+// set.
+type share struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Created      time.Time  `json:"created"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	Expires      time.Time  `json:"expires"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+	Downloads    int        `json:"downloads"`
+	LastAccess   *time.Time `json:"last_access,omitempty"`
+	Revoked      *time.Time `json:"revoked,omitempty"`
+}
+
+// status explains why s can no longer be used, or is empty while it can.
+func (s *share) status() string {
+	switch {
+	case s.Revoked != nil:
+		return "Link has been revoked"
+	case time.Now().After(s.Expires):
+		return "Link has expired"
+	case s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads:
+		return "Link has reached its download limit"
+	}
+	return ""
+}
+
+// shareRequest is the body of POST /admin/shares.
+type shareRequest struct {
+	Name         string `json:"name"`
+	ExpiresIn    string `json:"expires_in"`
+	MaxDownloads int    `json:"max_downloads"`
+	Password     string `json:"password"`
+}
+
+// shareInfo describes a share in admin responses; the password hash is
+// never returned.
+type shareInfo struct {
+	ID           string     `json:"id"`
+	URL          string     `json:"url"`
+	Name         string     `json:"name"`
+	Created      time.Time  `json:"created"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	Expires      time.Time  `json:"expires"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Protected    bool       `json:"password_protected"`
+	Downloads    int        `json:"downloads"`
+	LastAccess   *time.Time `json:"last_access,omitempty"`
+	Revoked      *time.Time `json:"revoked,omitempty"`
+	Active       bool       `json:"active"`
+}
+
+// shareHandler serves share downloads under /s/ and their management under
+// /admin/shares. Shares are kept as one JSON record per ID in dir and are
+// removed once expired.
+type shareHandler struct {
+	dir       string
+	store     Storage
+	names     *namer
+	publicURL string
+
+	// mu serializes updates to the records, e.g. download counts
+	mu sync.Mutex
+}
+
+func newShareHandler(dir string, store Storage, names *namer, publicURL string) (*shareHandler, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	h := &shareHandler{dir: dir, store: store, names: names, publicURL: publicURL}
+	h.removeExpired()
+	return h, nil
+}
+
+// ServeHTTP handles GET and HEAD /s/{id}, downloading the shared file. A
+// password is taken from HTTP Basic auth, so browsers prompt for it.
+func (h *shareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/s/")
+	s, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	if msg := s.status(); msg != "" {
+		writeError(w, r, http.StatusGone, codeNotFound, msg)
+		return
+	}
+	if s.PasswordHash != "" {
+		_, password, _ := r.BasicAuth()
+		if bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="shared file"`)
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "Password required")
+			return
+		}
+	}
+	if _, err := h.store.Stat(s.Name); err != nil {
+		writeStorageError(w, r, err, "Failed to read file")
+		return
+	}
+	if r.Method != http.MethodGet {
+		serveFile(w, r, h.store, h.names, s.Name)
+		return
+	}
+	if !h.count(w, r, id) {
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	serveFile(rec, r, h.store, h.names, s.Name)
+	if rec.status == http.StatusNotModified || rec.status >= 400 {
+		// Every response with content counts, ranges included, so a
+		// single-use link can't be read again piece by piece
+		h.uncount(id)
+	}
+}
+
+// statusRecorder remembers the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// count records a download of share id before it is served, re-checking
+// its limits so concurrent requests can't exceed them. uncount takes it
+// back if no content was sent, for a 304 or an error.
+func (h *shareHandler) count(w http.ResponseWriter, r *http.Request, id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.load(w, r, id)
+	if !ok {
+		return false
+	}
+	if msg := s.status(); msg != "" {
+		writeError(w, r, http.StatusGone, codeNotFound, msg)
+		return false
+	}
+	now := time.Now()
+	s.Downloads++
+	s.LastAccess = &now
+	if err := h.save(s); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to update share")
+		log.Printf("Failed to save share %s: %v", id, err)
+		return false
+	}
+	log.Printf("Shared file downloaded: %s via %s (%d)", s.Name, id, s.Downloads)
+	return true
+}
+
+func (h *shareHandler) uncount(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, err := h.read(id)
+	if err != nil {
+		log.Printf("Failed to read share %s: %v", id, err)
+		return
+	}
+	s.Downloads = max(s.Downloads-1, 0)
+	if err := h.save(s); err != nil {
+		log.Printf("Failed to save share %s: %v", id, err)
+	}
+}
+
+// admin handles /admin/shares: POST creates a share, GET lists them, and
+// GET or DELETE /admin/shares/{id} shows or revokes one.
+func (h *shareHandler) admin(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/shares"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		h.create(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		h.list(w, r)
+	case id != "" && (r.Method == http.MethodGet || r.Method == http.MethodDelete):
+		s, ok := h.load(w, r, id)
+		if !ok || !h.owns(w, r, s) {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			s, ok = h.revoke(w, r, id)
+			if !ok {
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, h.info(r, s))
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (h *shareHandler) create(w http.ResponseWriter, r *http.Request) {
+	req := shareRequest{ExpiresIn: defaultShareExpiry.String()}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid JSON body")
+		return
+	}
+	expiresIn, err := time.ParseDuration(req.ExpiresIn)
+	if err != nil || expiresIn <= 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid expires_in (e.g. 24h)")
+		return
+	}
+	if req.MaxDownloads < 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "max_downloads must not be negative")
+		return
+	}
+	if !validStoredName(req.Name) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidFilename, "Invalid filename")
+		return
+	}
+	s := &share{
+		ID:           randomHex(16),
+		Name:         req.Name,
+		Created:      time.Now().UTC().Truncate(time.Second),
+		Expires:      time.Now().UTC().Add(expiresIn).Truncate(time.Second),
+		MaxDownloads: req.MaxDownloads,
+	}
+	if token := requestToken(r); token != nil {
+		s.CreatedBy = token.Name
+	}
+	if !h.owns(w, r, s) {
+		return
+	}
+	if _, err := h.store.Stat(s.Name); err != nil {
+		writeStorageError(w, r, err, "Failed to read file")
+		return
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid password")
+			return
+		}
+		s.PasswordHash = string(hash)
+	}
+
+	if err := h.save(s); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to save share")
+		log.Printf("Failed to save share %s: %v", s.ID, err)
+		return
+	}
+	log.Printf("Share created: %s for %s", s.ID, s.Name)
+	writeJSON(w, http.StatusCreated, h.info(r, s))
+}
+
+// list returns the shares the token may see, optionally only those of one
+// file, newest first.
+func (h *shareHandler) list(w http.ResponseWriter, r *http.Request) {
+	h.removeExpired()
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to list shares")
+		log.Printf("Failed to list shares: %v", err)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	token := requestToken(r)
+	shares := []shareInfo{}
+	for _, entry := range entries {
+		s, err := h.read(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || (name != "" && s.Name != name) || !token.allows(s.Name) {
+			continue
+		}
+		shares = append(shares, h.info(r, s))
+	}
+	slices.SortFunc(shares, func(a, b shareInfo) int { return b.Created.Compare(a.Created) })
+	writeJSON(w, http.StatusOK, map[string]any{"shares": shares})
+}
+
+func (h *shareHandler) revoke(w http.ResponseWriter, r *http.Request, id string) (*share, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.load(w, r, id)
+	if !ok {
+		return nil, false
+	}
+	if s.Revoked == nil {
+		now := time.Now().UTC().Truncate(time.Second)
+		s.Revoked = &now
+		if err := h.save(s); err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to revoke share")
+			log.Printf("Failed to save share %s: %v", id, err)
+			return nil, false
+		}
+		log.Printf("Share revoked: %s for %s", id, s.Name)
+	}
+	return s, true
+}
+
+// owns checks that a prefix-limited token may manage shares of the file.
+func (h *shareHandler) owns(w http.ResponseWriter, r *http.Request, s *share) bool {
+	if token := requestToken(r); !token.allows(s.Name) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "Token is limited to "+token.Prefix+"/")
+		return false
+	}
+	return true
+}
+
+func (h *shareHandler) info(r *http.Request, s *share) shareInfo {
+	return shareInfo{
+		ID:           s.ID,
+		URL:          strings.TrimSuffix(baseURL(r, h.publicURL), "/") + "/s/" + s.ID,
+		Name:         s.Name,
+		Created:      s.Created,
+		CreatedBy:    s.CreatedBy,
+		Expires:      s.Expires,
+		MaxDownloads: s.MaxDownloads,
+		Protected:    s.PasswordHash != "",
+		Downloads:    s.Downloads,
+		LastAccess:   s.LastAccess,
+		Revoked:      s.Revoked,
+		Active:       s.status() == "",
+	}
+}
+
+// load reads a share, writing 404 if it doesn't exist. Expired shares are
+// still returned so callers can report them as gone.
+func (h *shareHandler) load(w http.ResponseWriter, r *http.Request, id string) (*share, bool) {
+	s, err := h.read(id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Link not found")
+		} else {
+			writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to read share")
+			log.Printf("Failed to read share %s: %v", id, err)
+		}
+		return nil, false
+	}
+	return s, true
+}
+
+func (h *shareHandler) read(id string) (*share, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return nil, fs.ErrNotExist
+	}
+	data, err := os.ReadFile(h.path(id))
+	if err != nil {
+		return nil, err
+	}
+	var s share
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// save writes the share record atomically.
+func (h *shareHandler) save(s *share) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := h.path(s.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path(s.ID))
+}
+
+// removeExpired deletes shares a day past their expiry, keeping them
+// around briefly so visitors get 410 rather than 404.
+func (h *shareHandler) removeExpired() {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		log.Printf("Failed to list shares: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if s, err := h.read(id); err == nil && time.Since(s.Expires) > 24*time.Hour {
+			os.Remove(h.path(id))
+			log.Printf("Share expired: %s", id)
+		}
+	}
+}
+
+func (h *shareHandler) path(id string) string {
+	return filepath.Join(h.dir, id+".json")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareHandler(t *testing.T) {
+	store, _ := newFileStorage(t.TempDir())
+	names, _ := newNamer(defaultNameTemplate)
+	store.Put("report.pdf", strings.NewReader("quarterly numbers"))
+	store.Put("acme/invoice.pdf", strings.NewReader("invoice"))
+	shares, err := newShareHandler(t.TempDir(), store, names, "https://files.example.com")
+	if err != nil {
+		t.Fatalf("newShareHandler failed: %v", err)
+	}
+	tokens, _ := parseTokens(strings.NewReader("ops ops-secret-0123456789 admin; acme acme-secret-0123456789 admin acme"))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/shares", shares.admin)
+	mux.HandleFunc("/admin/shares/", shares.admin)
+	mux.Handle("/s/", shares)
+	handler := (&authenticator{tokens: tokens}).middleware(mux)
+
+	do := func(method, target, secret, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Accept", "application/json")
+		if secret != "" {
+			r.Header.Set("Authorization", "Bearer "+secret)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	create := func(body string) shareInfo {
+		w := do(http.MethodPost, "/admin/shares", "ops-secret-0123456789", body)
+		var info shareInfo
+		json.NewDecoder(w.Body).Decode(&info)
+		if w.Code != http.StatusCreated || !strings.HasPrefix(info.URL, "https://files.example.com/s/") {
+			t.Fatalf("Expected a share, got %d %+v", w.Code, info)
+		}
+		return info
+	}
+	download := func(info shareInfo, password string) *httptest.ResponseRecorder {
+		u, _ := url.Parse(info.URL)
+		r := httptest.NewRequest(http.MethodGet, u.Path, nil)
+		if password != "" {
+			r.SetBasicAuth("", password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	get := func(id string) shareInfo {
+		var info shareInfo
+		json.NewDecoder(do(http.MethodGet, "/admin/shares/"+id, "ops-secret-0123456789", "").Body).Decode(&info)
+		return info
+	}
+
+	t.Run("downloads are counted", func(t *testing.T) {
+		info := create(`{"name": "report.pdf", "expires_in": "1h"}`)
+		for i := 0; i < 2; i++ {
+			if w := download(info, ""); w.Code != http.StatusOK || w.Body.String() != "quarterly numbers" {
+				t.Fatalf("Expected the file, got %d %q", w.Code, w.Body)
+			}
+		}
+		if got := get(info.ID); got.Downloads != 2 || got.LastAccess == nil || !got.Active {
+			t.Errorf("Expected 2 downloads, got %+v", got)
+		}
+	})
+
+	t.Run("ranges count, 304s and errors don't", func(t *testing.T) {
+		conditional := func(info shareInfo, header, value string) *httptest.ResponseRecorder {
+			u, _ := url.Parse(info.URL)
+			r := httptest.NewRequest(http.MethodGet, u.Path, nil)
+			r.Header.Set(header, value)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w
+		}
+
+		info := create(`{"name": "report.pdf", "max_downloads": 1}`)
+		if w := conditional(info, "Range", "bytes=0-"); w.Code != http.StatusPartialContent || w.Body.String() != "quarterly numbers" {
+			t.Fatalf("Expected the whole file as a range, got %d %q", w.Code, w.Body)
+		}
+		if w := conditional(info, "Range", "bytes=0-"); w.Code != http.StatusGone {
+			t.Errorf("Expected the range to use up the single-use link, got %d", w.Code)
+		}
+		if w := download(info, ""); w.Code != http.StatusGone {
+			t.Errorf("Expected 410 after the range download, got %d", w.Code)
+		}
+
+		info = create(`{"name": "report.pdf", "max_downloads": 1}`)
+		if w := conditional(info, "Range", "bytes=1000-"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("Expected 416, got %d", w.Code)
+		}
+		full := download(info, "")
+		if full.Code != http.StatusOK {
+			t.Fatalf("Expected an unsatisfiable range not to count, got %d", full.Code)
+		}
+
+		info = create(`{"name": "report.pdf"}`)
+		if w := conditional(info, "If-None-Match", full.Header().Get("ETag")); w.Code != http.StatusNotModified {
+			t.Fatalf("Expected 304, got %d", w.Code)
+		}
+		if got := get(info.ID); got.Downloads != 0 {
+			t.Errorf("Expected a 304 not to count, got %d downloads", got.Downloads)
+		}
+	})
+
+	t.Run("single use", func(t *testing.T) {
+		info := create(`{"name": "report.pdf", "max_downloads": 1}`)
+		if w := download(info, ""); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w := download(info, ""); w.Code != http.StatusGone {
+			t.Errorf("Expected 410 on the second download, got %d", w.Code)
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		info := create(`{"name": "report.pdf", "password": "hunter2"}`)
+		if !info.Protected {
+			t.Errorf("Expected the share to be marked protected")
+		}
+		for _, password := range []string{"", "wrong"} {
+			if w := download(info, password); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected a 401 challenge for %q, got %d", password, w.Code)
+			}
+		}
+		if w := download(info, "hunter2"); w.Code != http.StatusOK {
+			t.Errorf("Expected 200 with the password, got %d", w.Code)
+		}
+		if got := get(info.ID); got.Downloads != 1 {
+			t.Errorf("Expected only the successful download to count, got %d", got.Downloads)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		info := create(`{"name": "report.pdf"}`)
+		if w := do(http.MethodDelete, "/admin/shares/"+info.ID, "ops-secret-0123456789", ""); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w := download(info, ""); w.Code != http.StatusGone {
+			t.Errorf("Expected 410 after revocation, got %d", w.Code)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		info := create(`{"name": "report.pdf"}`)
+		s, _ := shares.read(info.ID)
+		s.Expires = time.Now().Add(-time.Minute)
+		shares.save(s)
+		if w := download(info, ""); w.Code != http.StatusGone {
+			t.Errorf("Expected 410 after expiry, got %d", w.Code)
+		}
+	})
+
+	t.Run("unknown link", func(t *testing.T) {
+		if w := download(shareInfo{URL: "/s/" + randomHex(16)}, ""); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid requests", func(t *testing.T) {
+		for _, body := range []string{`{"name": "missing.pdf"}`, `{"name": "../etc/passwd"}`, `{"name": "report.pdf", "expires_in": "-1h"}`} {
+			if w := do(http.MethodPost, "/admin/shares", "ops-secret-0123456789", body); w.Code < 400 {
+				t.Errorf("Expected %s to be refused, got %d", body, w.Code)
+			}
+		}
+	})
+
+	t.Run("prefix-limited tokens only see their files", func(t *testing.T) {
+		if w := do(http.MethodPost, "/admin/shares", "acme-secret-0123456789", `{"name": "report.pdf"}`); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 outside the prefix, got %d", w.Code)
+		}
+		if w := do(http.MethodPost, "/admin/shares", "acme-secret-0123456789", `{"name": "acme/invoice.pdf"}`); w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201 inside the prefix, got %d", w.Code)
+		}
+		var resp struct{ Shares []shareInfo }
+		json.NewDecoder(do(http.MethodGet, "/admin/shares", "acme-secret-0123456789", "").Body).Decode(&resp)
+		if len(resp.Shares) != 1 || resp.Shares[0].Name != "acme/invoice.pdf" || resp.Shares[0].CreatedBy != "acme" {
+			t.Errorf("Expected only the acme share, got %+v", resp.Shares)
+		}
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage is where uploaded files end up. Names are the final stored names
+// (e.g. "20250923_143022_123456_9f86d081_test.pdf"), possibly containing
+// "/" when NAME_TEMPLATE uses subdirectories. Missing files are reported as
+// fs.ErrNotExist so handlers can map them to 404 regardless of backend.
+// Put never overwrites: if name is taken it fails with fs.ErrExist, before
+// reading r so the caller can retry under a different name, unless another
+// writer created it meanwhile. Replace
+// overwrites atomically, so readers see either the old or the new file.
+// List leaves out hidden names (any segment starting with "."), which hold
+// internal records such as metadata sidecars.
+type Storage interface {
+	Put(name string, r io.Reader) (int64, error)
+	Replace(name string, r io.Reader) (int64, error)
+	Get(name string) (io.ReadSeekCloser, error)
+	Stat(name string) (FileInfo, error)
+	List() ([]FileInfo, error)
+	Delete(name string) error
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// newStorage returns the backend selected by STORAGE_BACKEND.
+func newStorage(backend, uploadDir string) (Storage, error) {
+	switch backend {
+	case "", "filesystem":
+		return newFileStorage(uploadDir)
+	case "s3":
+		return newS3Storage(s3ConfigFromEnv())
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// fileStorage keeps uploads as plain files in a directory.
+type fileStorage struct {
+	dir string
+}
+
+func newFileStorage(dir string) (*fileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &fileStorage{dir: dir}
+	removed, err := s.sweepTempFiles()
+	if err != nil {
+		return nil, fmt.Errorf("sweeping temp files: %w", err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d incomplete upload(s) from %s", removed, dir)
+	}
+	return s, nil
+}
+
+// path maps a stored name to a path inside dir, refusing anything that
+// would escape it.
+func (s *fileStorage) path(name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid name %q: %w", name, fs.ErrNotExist)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// tempPattern names in-progress uploads. They are hidden, so they never show
+// up in listings or downloads.
+const tempPattern = ".upload-*.tmp"
+
+// Put writes to a hidden temp file next to the final path, syncs it, and
+// only then links it into place, so readers never see a partial upload.
+// Linking rather than renaming keeps creation exclusive.
+func (s *fileStorage) Put(name string, r io.Reader) (int64, error) {
+	return s.write(name, r, true)
+}
+
+func (s *fileStorage) Replace(name string, r io.Reader) (int64, error) {
+	return s.write(name, r, false)
+}
+
+// write streams r into a temp file next to the destination and moves it
+// into place once complete, so readers never see a partial file.
+func (s *fileStorage) write(name string, r io.Reader, exclusive bool) (int64, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return 0, err
+	}
+
+	// Cheap early check so callers can retry before r is consumed; the
+	// link below is what actually guarantees no overwrite
+	if _, err := os.Lstat(path); err == nil && exclusive {
+		return 0, fmt.Errorf("%s: %w", name, fs.ErrExist)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPattern)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+
+	if !exclusive {
+		return n, os.Rename(tmp.Name(), path)
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return n, fmt.Errorf("%s was created by a concurrent upload: %w", name, fs.ErrExist)
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+// sweepTempFiles removes temp files left behind by uploads that were
+// interrupted by a crash or restart.
+func (s *fileStorage) sweepTempFiles() (int, error) {
+	removed := 0
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if ok, _ := filepath.Match(tempPattern, entry.Name()); ok {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (s *fileStorage) Get(name string) (io.ReadSeekCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *fileStorage) Stat(name string) (FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if info.IsDir() {
+		return FileInfo{}, fmt.Errorf("%s is a directory: %w", name, fs.ErrNotExist)
+	}
+	return FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *fileStorage) List() ([]FileInfo, error) {
+	var files []FileInfo
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip hidden files and directories such as .gitkeep
+		if path != s.dir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed between ReadDir and Info
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Name: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (s *fileStorage) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// Clean up subdirectories created by the name template once empty;
+	// os.Remove refuses to remove non-empty directories
+	for dir := filepath.Dir(path); dir != filepath.Clean(s.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of each part in a multipart upload. Files smaller
+// than this are sent with a single PutObject.
+const s3PartSize = 8 * 1024 * 1024
+
+// emptyPayloadHash is the SHA-256 of an empty body, used to sign requests
+// without a payload.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Config holds the settings for an S3-compatible bucket.
+type s3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// s3ConfigFromEnv reads the S3_* environment variables.
+func s3ConfigFromEnv() s3Config {
+	return s3Config{
+		Endpoint:  getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		Region:    getEnv("S3_REGION", "us-east-1"),
+		Bucket:    getEnv("S3_BUCKET", ""),
+		Prefix:    getEnv("S3_PREFIX", ""),
+		AccessKey: getEnv("S3_ACCESS_KEY", ""),
+		SecretKey: getEnv("S3_SECRET_KEY", ""),
+	}
+}
+
+// s3Storage stores uploads as objects in an S3-compatible bucket using
+// path-style requests signed with AWS Signature Version 4.
+type s3Storage struct {
+	cfg      s3Config
+	client   *http.Client
+	partSize int
+}
+
+func newS3Storage(cfg s3Config) (*s3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3_BUCKET is required for the s3 backend")
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT: %w", err)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	return &s3Storage{cfg: cfg, client: http.DefaultClient, partSize: s3PartSize}, nil
+}
+
+func (s *s3Storage) Put(name string, r io.Reader) (int64, error) {
+	// Check for an existing object before consuming r so callers can retry
+	// with another name; If-None-Match below covers the remaining race
+	if _, err := s.Stat(name); err == nil {
+		return 0, fmt.Errorf("s3: %s: %w", name, fs.ErrExist)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return s.put(name, r, true)
+}
+
+// Replace relies on S3 writes being atomic: the new object only becomes
+// visible once PutObject or CompleteMultipartUpload succeeds.
+func (s *s3Storage) Replace(name string, r io.Reader) (int64, error) {
+	return s.put(name, r, false)
+}
+
+func (s *s3Storage) put(name string, r io.Reader, exclusive bool) (int64, error) {
+	key := s.cfg.Prefix + name
+
+	// Read the first part; if the body fits, a single PutObject is enough
+	buf := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.doFinal(exclusive, http.MethodPut, key, nil, buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return s.putMultipart(key, buf, r, exclusive)
+}
+
+// putMultipart uploads first followed by the rest of r as a multipart
+// upload, aborting it if anything fails.
+func (s *s3Storage) putMultipart(key string, first []byte, r io.Reader, exclusive bool) (int64, error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("s3: decoding CreateMultipartUpload response: %w", err)
+	}
+
+	total, err := s.uploadParts(key, initiated.UploadID, first, r, exclusive)
+	if err != nil {
+		if resp, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return total, err
+	}
+	return total, nil
+}
+
+func (s *s3Storage) uploadParts(key, uploadID string, first []byte, r io.Reader, exclusive bool) (int64, error) {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var parts []part
+	var total int64
+
+	buf := first
+	for number := 1; ; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(http.MethodPut, key, query, buf)
+		if err != nil {
+			return total, err
+		}
+		resp.Body.Close()
+		parts = append(parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		total += int64(len(buf))
+
+		buf = make([]byte, s.partSize)
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return total, err
+		}
+		buf = buf[:n]
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return total, err
+	}
+	resp, err := s.doFinal(exclusive, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return total, err
+	}
+	defer resp.Body.Close()
+
+	// CompleteMultipartUpload can fail with a 200 status and an error body
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return total, err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return total, parseS3Error(resp.StatusCode, data)
+	}
+	return total, nil
+}
+
+func (s *s3Storage) Get(name string) (io.ReadSeekCloser, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{store: s, key: s.cfg.Prefix + name, size: info.Size}, nil
+}
+
+func (s *s3Storage) Stat(name string) (FileInfo, error) {
+	resp, err := s.do(http.MethodHead, s.cfg.Prefix+name, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Storage) List() ([]FileInfo, error) {
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+				Size         int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: decoding ListObjectsV2 response: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			// Skip hidden objects such as metadata sidecars, like the
+			// filesystem backend does
+			name := strings.TrimPrefix(obj.Key, s.cfg.Prefix)
+			if strings.HasPrefix(name, ".") || strings.Contains(name, "/.") {
+				continue
+			}
+			files = append(files, FileInfo{
+				Name:    name,
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	// S3 deletes are idempotent, so check existence first to report 404s
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.cfg.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for key (or the bucket itself when key is
+// empty) and turns non-2xx responses into errors. 404s wrap fs.ErrNotExist.
+func (s *s3Storage) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := s.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.send(req)
+}
+
+// doFinal sends the request that makes an object visible, with
+// If-None-Match when the write must not replace an existing object.
+func (s *s3Storage) doFinal(exclusive bool, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	if !exclusive {
+		return s.do(method, key, query, body)
+	}
+	return s.doExclusive(method, key, query, body)
+}
+
+// doExclusive is like do but fails with fs.ErrExist instead of replacing an
+// existing object. S3 only answers 412 after the body was sent, so the
+// caller's reader is already consumed by then.
+func (s *s3Storage) doExclusive(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := s.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("If-None-Match", "*")
+	return s.send(req)
+}
+
+// newRequest builds a signed request for key (or the bucket itself when key
+// is empty).
+func (s *s3Storage) newRequest(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	path := "/" + s3Escape(s.cfg.Bucket)
+	if key != "" {
+		path += "/" + s3EscapePath(key)
+	}
+	rawQuery := s3CanonicalQuery(query)
+
+	target := s.cfg.Endpoint + path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, rawQuery, body, time.Now().UTC())
+	return req, nil
+}
+
+// send performs req, turning non-2xx responses into errors.
+func (s *s3Storage) send(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return nil, parseS3Error(resp.StatusCode, data)
+	}
+	return resp, nil
+}
+
+// s3Object reads an object lazily, issuing a ranged GET from the current
+// offset on the first Read after each Seek. This lets http.ServeContent
+// serve byte ranges without downloading the whole object.
+type s3Object struct {
+	store  *s3Storage
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := o.store.newRequest(http.MethodGet, o.key, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+		resp, err := o.store.send(req)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *s3Storage) sign(req *http.Request, path, rawQuery string, body []byte, now time.Time) {
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, rawQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters,
+// as required by the SigV4 canonical request.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath escapes each segment of an object key, keeping slashes.
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes query sorted by key as SigV4 expects.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// parseS3Error builds an error from an S3 error response body.
+func parseS3Error(status int, body []byte) error {
+	var s3err struct {
+		Code    string
+		Message string
+	}
+	xml.Unmarshal(body, &s3err)
+
+	if status == http.StatusNotFound || s3err.Code == "NoSuchKey" {
+		return fmt.Errorf("s3: %s: %w", s3err.Code, fs.ErrNotExist)
+	}
+	if status == http.StatusPreconditionFailed || s3err.Code == "PreconditionFailed" {
+		return fmt.Errorf("s3: object was created by a concurrent upload: %w", fs.ErrExist)
+	}
+	if s3err.Code == "" {
+		return fmt.Errorf("s3: unexpected status %d", status)
+	}
+	return fmt.Errorf("s3: %s: %s", s3err.Code, s3err.Message)
+}
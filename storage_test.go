@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStorage(t *testing.T) {
+	t.Run("put, get, stat, list and delete", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := newFileStorage(dir)
+		if err != nil {
+			t.Fatalf("newFileStorage failed: %v", err)
+		}
+
+		if n, err := store.Put("2025/09/report.txt", strings.NewReader("hello")); err != nil || n != 5 {
+			t.Fatalf("Expected 5 bytes written, got %d (%v)", n, err)
+		}
+		store.Put("notes.txt", strings.NewReader("hi"))
+		os.WriteFile(filepath.Join(dir, ".gitkeep"), nil, 0644)
+
+		rc, err := store.Get("2025/09/report.txt")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		rc.Seek(1, io.SeekStart)
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != "ello" {
+			t.Errorf("Expected 'ello' after seeking, got '%s'", data)
+		}
+
+		info, err := store.Stat("2025/09/report.txt")
+		if err != nil || info.Name != "2025/09/report.txt" || info.Size != 5 || info.ModTime.IsZero() {
+			t.Errorf("Unexpected Stat result: %+v (%v)", info, err)
+		}
+		if _, err := store.Stat("2025/09"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected fs.ErrNotExist for a directory, got %v", err)
+		}
+
+		files, _ := store.List()
+		if len(files) != 2 || files[0].Name != "2025/09/report.txt" || files[1].Name != "notes.txt" {
+			t.Errorf("Expected both files sorted, without hidden ones, got %v", files)
+		}
+
+		if err := store.Delete("2025/09/report.txt"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "2025")); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected empty subdirectories to be removed, got %v", err)
+		}
+		if _, err := store.Get("2025/09/report.txt"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected fs.ErrNotExist after Delete, got %v", err)
+		}
+		if err := store.Delete("2025/09/report.txt"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected fs.ErrNotExist deleting twice, got %v", err)
+		}
+	})
+
+	t.Run("names can't escape the directory", func(t *testing.T) {
+		dir := t.TempDir()
+		store, _ := newFileStorage(filepath.Join(dir, "uploads"))
+		os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644)
+
+		for _, name := range []string{"../secret.txt", "/etc/passwd", "a/../../secret.txt"} {
+			if _, err := store.Get(name); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected Get(%q) to fail with fs.ErrNotExist, got %v", name, err)
+			}
+			if _, err := store.Put(name, strings.NewReader("x")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected Put(%q) to fail with fs.ErrNotExist, got %v", name, err)
+			}
+			if err := store.Delete(name); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected Delete(%q) to fail with fs.ErrNotExist, got %v", name, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "secret.txt")); err != nil {
+			t.Errorf("Expected the file outside to be untouched, got %v", err)
+		}
+	})
+
+	t.Run("interrupted upload leaves nothing behind", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := newFileStorage(dir)
+		if err != nil {
+			t.Fatalf("newFileStorage failed: %v", err)
+		}
+
+		readErr := errors.New("client went away")
+		body := io.MultiReader(strings.NewReader("partial"), &errReader{readErr})
+		if _, err := store.Put("20250923/broken.txt", body); !errors.Is(err, readErr) {
+			t.Errorf("Expected read error, got %v", err)
+		}
+
+		err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				t.Errorf("Expected no files, found %s", path)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("WalkDir failed: %v", err)
+		}
+	})
+
+	t.Run("put is exclusive", func(t *testing.T) {
+		store, _ := newFileStorage(t.TempDir())
+		if _, err := store.Put("taken.txt", strings.NewReader("first")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+
+		body := strings.NewReader("second")
+		if _, err := store.Put("taken.txt", body); !errors.Is(err, fs.ErrExist) {
+			t.Errorf("Expected fs.ErrExist, got %v", err)
+		}
+		if body.Len() != len("second") {
+			t.Errorf("Expected body to be left unread for a retry")
+		}
+
+		rc, err := store.Get("taken.txt")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		defer rc.Close()
+		if data, _ := io.ReadAll(rc); string(data) != "first" {
+			t.Errorf("Expected original content, got '%s'", data)
+		}
+	})
+
+	t.Run("replace overwrites", func(t *testing.T) {
+		store, _ := newFileStorage(t.TempDir())
+		store.Put("2025/report.txt", strings.NewReader("first"))
+
+		if _, err := store.Replace("2025/report.txt", strings.NewReader("second")); err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+		if _, err := store.Replace("2025/new.txt", strings.NewReader("new")); err != nil {
+			t.Fatalf("Replace of a new file failed: %v", err)
+		}
+
+		rc, err := store.Get("2025/report.txt")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		defer rc.Close()
+		if data, _ := io.ReadAll(rc); string(data) != "second" {
+			t.Errorf("Expected replaced content, got '%s'", data)
+		}
+		if files, _ := store.List(); len(files) != 2 {
+			t.Errorf("Expected 2 files and no leftovers, got %v", files)
+		}
+	})
+
+	t.Run("startup sweeps orphaned temp files", func(t *testing.T) {
+		dir := t.TempDir()
+		orphan := filepath.Join(dir, "20250923", ".upload-123.tmp")
+		os.MkdirAll(filepath.Dir(orphan), 0755)
+		os.WriteFile(orphan, []byte("half"), 0644)
+		os.WriteFile(filepath.Join(dir, "keep.txt"), []byte("keep"), 0644)
+
+		store, err := newFileStorage(dir)
+		if err != nil {
+			t.Fatalf("newFileStorage failed: %v", err)
+		}
+		if _, err := os.Stat(orphan); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected orphaned temp file to be removed, got %v", err)
+		}
+
+		files, _ := store.List()
+		if len(files) != 1 || files[0].Name != "keep.txt" {
+			t.Errorf("Expected only keep.txt to remain, got %v", files)
+		}
+	})
+}
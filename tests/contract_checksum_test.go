@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"hash/crc32"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func uploadWithChecksums(t *testing.T, name, content string, headers map[string]string) (int, storedFile) {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/upload", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Filename", name)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Files []storedFile `json:"files"`
+		Error *struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(body.Files) == 0 {
+		code := ""
+		if body.Error != nil {
+			code = body.Error.Code
+		}
+		return resp.StatusCode, storedFile{Error: &struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}{Code: code}}
+	}
+	return resp.StatusCode, body.Files[0]
+}
+
+// TestUploadChecksums tests checksum computation and verification
+func TestUploadChecksums(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	content := "checksummed content"
+	sha := sha256.Sum256([]byte(content))
+	md := md5.Sum([]byte(content))
+	crc := crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli))
+	crcHex := hex.EncodeToString([]byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)})
+
+	t.Run("matching Content-MD5 is accepted and echoed", func(t *testing.T) {
+		status, file := uploadWithChecksums(t, "md5.txt", content, map[string]string{
+			"Content-MD5": base64.StdEncoding.EncodeToString(md[:]),
+		})
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+		if file.MD5 != hex.EncodeToString(md[:]) || file.SHA256 != hex.EncodeToString(sha[:]) {
+			t.Errorf("Unexpected checksums: md5 %s, sha256 %s", file.MD5, file.SHA256)
+		}
+	})
+
+	t.Run("Want-Repr-Digest adds optional checksums", func(t *testing.T) {
+		status, file := uploadWithChecksums(t, "want.txt", content, map[string]string{
+			"Want-Repr-Digest": "crc32c=5, sha-256=10",
+		})
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+		if file.CRC32C != crcHex {
+			t.Errorf("Expected crc32c %s, got '%s'", crcHex, file.CRC32C)
+		}
+		if file.MD5 != "" {
+			t.Errorf("Expected no md5 unless asked for, got '%s'", file.MD5)
+		}
+	})
+
+	t.Run("mismatching Repr-Digest is rejected", func(t *testing.T) {
+		wrong := sha256.Sum256([]byte("something else"))
+		status, file := uploadWithChecksums(t, "mismatch.txt", content, map[string]string{
+			"Repr-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(wrong[:]) + ":",
+		})
+		if status != http.StatusBadRequest {
+			t.Fatalf("Expected status 400, got %d", status)
+		}
+		if file.Error == nil || file.Error.Code != "checksum_mismatch" {
+			t.Errorf("Expected checksum_mismatch error, got %+v", file.Error)
+		}
+		if file.StoredName != "" {
+			t.Errorf("Expected no stored name, got '%s'", file.StoredName)
+		}
+	})
+
+	t.Run("malformed digest is rejected", func(t *testing.T) {
+		status, file := uploadWithChecksums(t, "bad.txt", content, map[string]string{"Content-MD5": "not-a-digest"})
+		if status != http.StatusBadRequest {
+			t.Fatalf("Expected status 400, got %d", status)
+		}
+		if file.Error == nil || file.Error.Code != "invalid_request" {
+			t.Errorf("Expected invalid_request error, got %+v", file.Error)
+		}
+	})
+
+	t.Run("PUT with a wrong digest keeps the existing file", func(t *testing.T) {
+		name := "checksum_" + time.Now().Format("150405.000000") + ".txt"
+		t.Cleanup(func() {
+			req, _ := http.NewRequest("DELETE", "http://localhost:8080/files/"+name, nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		})
+
+		if resp := putFile(t, name, "original", nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+		}
+		resp := putFile(t, name, content, map[string]string{"Digest": "md5=" + base64.StdEncoding.EncodeToString(make([]byte, 16))})
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status 400, got %d", resp.StatusCode)
+		}
+		if got := getContent(t, name); got != "original" {
+			t.Errorf("Expected 'original', got '%s'", got)
+		}
+	})
+
+	t.Run("multipart checksum fields apply to the next file", func(t *testing.T) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("crc32c", crcHex)
+		part, _ := writer.CreateFormFile("file", "first.txt")
+		part.Write([]byte(content))
+		writer.WriteField("md5", hex.EncodeToString(make([]byte, 16)))
+		part, _ = writer.CreateFormFile("file", "second.txt")
+		part.Write([]byte(content))
+		writer.Close()
+
+		req, _ := http.NewRequest("POST", "http://localhost:8080/upload", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMultiStatus {
+			t.Fatalf("Expected status 207, got %d", resp.StatusCode)
+		}
+		var result struct {
+			Files []storedFile `json:"files"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		if len(result.Files) != 2 {
+			t.Fatalf("Expected 2 results, got %d", len(result.Files))
+		}
+		if result.Files[0].Status != http.StatusOK || result.Files[0].CRC32C != crcHex {
+			t.Errorf("Expected first file stored with crc32c %s, got %+v", crcHex, result.Files[0])
+		}
+		if result.Files[1].Status != http.StatusBadRequest {
+			t.Errorf("Expected second file rejected, got status %d", result.Files[1].Status)
+		}
+	})
+}
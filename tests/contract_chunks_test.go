@@ -0,0 +1,205 @@
+package tests
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type chunkSession struct {
+	ID        string `json:"id"`
+	ChunkSize int    `json:"chunk_size"`
+	Chunks    int    `json:"chunks"`
+	Received  []int  `json:"received"`
+}
+
+func chunkRequest(t *testing.T, method, url, body string, headers map[string]string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://localhost:8080"+url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	return resp
+}
+
+// initChunkedUpload starts a chunked upload and returns its session
+func initChunkedUpload(t *testing.T, filename string, size int) chunkSession {
+	t.Helper()
+
+	body := `{"filename": "` + filename + `", "size": ` + strconv.Itoa(size) + `, "chunk_size": 65536}`
+	resp := chunkRequest(t, "POST", "/chunks/", body, map[string]string{"Content-Type": "application/json"})
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+	var session chunkSession
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		t.Fatalf("Failed to decode session: %v", err)
+	}
+	return session
+}
+
+func putChunk(t *testing.T, session chunkSession, index int, chunk string) *http.Response {
+	t.Helper()
+
+	sum := sha256.Sum256([]byte(chunk))
+	resp := chunkRequest(t, "PUT", "/chunks/"+session.ID+"/"+strconv.Itoa(index), chunk, map[string]string{
+		"X-Chunk-SHA256": hex.EncodeToString(sum[:]),
+	})
+	resp.Body.Close()
+	return resp
+}
+
+// TestChunkedUpload tests the init/chunk/complete API under /chunks/
+func TestChunkedUpload(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	// Three chunks of 64 KiB, the last one short
+	content := strings.Repeat("abcdefgh", 20000)
+	chunk := func(i int) string {
+		return content[i*65536 : min((i+1)*65536, len(content))]
+	}
+
+	t.Run("Chunks sent out of order are assembled", func(t *testing.T) {
+		session := initChunkedUpload(t, "chunked.txt", len(content))
+		if session.Chunks != 3 {
+			t.Fatalf("Expected 3 chunks, got %d", session.Chunks)
+		}
+
+		for _, i := range []int{2, 0} {
+			if resp := putChunk(t, session, i, chunk(i)); resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("Expected status 204 for chunk %d, got %d", i, resp.StatusCode)
+			}
+		}
+
+		resp := chunkRequest(t, "GET", "/chunks/"+session.ID, "", nil)
+		var status chunkSession
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if len(status.Received) != 2 || status.Received[0] != 0 || status.Received[1] != 2 {
+			t.Errorf("Expected chunks [0 2] received, got %v", status.Received)
+		}
+
+		resp = chunkRequest(t, "POST", "/chunks/"+session.ID+"/complete", "", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected status 409 with a missing chunk, got %d", resp.StatusCode)
+		}
+
+		putChunk(t, session, 1, chunk(1))
+		resp = chunkRequest(t, "POST", "/chunks/"+session.ID+"/complete", "", nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
+		}
+		stored := strings.TrimPrefix(string(body), "File uploaded successfully: ")
+		if !strings.HasSuffix(stored, "_chunked.txt") {
+			t.Fatalf("Expected stored name ending in _chunked.txt, got '%s'", stored)
+		}
+
+		download, err := http.Get("http://localhost:8080/files/" + stored)
+		if err != nil {
+			t.Fatalf("Failed to download: %v", err)
+		}
+		defer download.Body.Close()
+		data, _ := io.ReadAll(download.Body)
+		if string(data) != content {
+			t.Errorf("Assembled file differs from the original (%d vs %d bytes)", len(data), len(content))
+		}
+
+		resp = chunkRequest(t, "GET", "/chunks/"+session.ID, "", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected completed session to be gone, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Checksum mismatch returns 400", func(t *testing.T) {
+		session := initChunkedUpload(t, "corrupt.txt", len(content))
+		sum := sha256.Sum256([]byte("something else"))
+		resp := chunkRequest(t, "PUT", "/chunks/"+session.ID+"/0", chunk(0), map[string]string{
+			"X-Chunk-SHA256": hex.EncodeToString(sum[:]),
+			"Accept":         "application/json",
+		})
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected status 400, got %d", resp.StatusCode)
+		}
+		var errResp struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		if errResp.Error.Code != "checksum_mismatch" {
+			t.Errorf("Expected code checksum_mismatch, got '%s'", errResp.Error.Code)
+		}
+	})
+
+	t.Run("Wrong chunk length returns 400", func(t *testing.T) {
+		session := initChunkedUpload(t, "short.txt", len(content))
+		if resp := putChunk(t, session, 0, "too short"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Chunk index out of range returns 400", func(t *testing.T) {
+		session := initChunkedUpload(t, "range.txt", len(content))
+		for _, index := range []int{-1, 3} {
+			if resp := putChunk(t, session, index, chunk(0)); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for chunk %d, got %d", index, resp.StatusCode)
+			}
+		}
+
+		resp := chunkRequest(t, "GET", "/chunks/"+session.ID, "", nil)
+		var status chunkSession
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if len(status.Received) != 0 {
+			t.Errorf("Expected no chunks received, got %v", status.Received)
+		}
+	})
+
+	t.Run("Size over the limit returns 413", func(t *testing.T) {
+		resp := chunkRequest(t, "POST", "/chunks/", `{"filename": "huge.bin", "size": 1099511627776}`, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("DELETE aborts the upload", func(t *testing.T) {
+		session := initChunkedUpload(t, "abort.txt", len(content))
+
+		resp := chunkRequest(t, "DELETE", "/chunks/"+session.ID, "", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if resp := putChunk(t, session, 0, chunk(0)); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404 after abort, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type davMultistatus struct {
+	Responses []struct {
+		Href         string `xml:"href"`
+		ResourceType struct {
+			Collection *struct{} `xml:"collection"`
+		} `xml:"propstat>prop>resourcetype"`
+		ContentLength string `xml:"propstat>prop>getcontentlength"`
+	} `xml:"response"`
+}
+
+func davRequest(t *testing.T, method, path, body string, headers map[string]string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	return resp
+}
+
+func propfind(t *testing.T, path, depth string) (int, davMultistatus) {
+	t.Helper()
+
+	resp := davRequest(t, "PROPFIND", path, "", map[string]string{"Depth": depth})
+	defer resp.Body.Close()
+
+	var status davMultistatus
+	if resp.StatusCode == http.StatusMultiStatus {
+		if err := xml.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("Failed to decode multistatus: %v", err)
+		}
+	}
+	return resp.StatusCode, status
+}
+
+// TestWebDAV tests the WebDAV handler mounted at /dav/
+func TestWebDAV(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	dir := "dav_" + time.Now().Format("150405_000000")
+	t.Cleanup(func() {
+		davRequest(t, "DELETE", "/dav/"+dir, "", nil).Body.Close()
+		davRequest(t, "DELETE", "/dav/"+dir+"_moved", "", nil).Body.Close()
+	})
+
+	t.Run("OPTIONS advertises DAV class 1 and 2", func(t *testing.T) {
+		resp := davRequest(t, "OPTIONS", "/dav/", "", nil)
+		resp.Body.Close()
+		if !strings.Contains(resp.Header.Get("DAV"), "2") {
+			t.Errorf("Expected DAV header with class 2, got '%s'", resp.Header.Get("DAV"))
+		}
+		if !strings.Contains(resp.Header.Get("Allow"), "PROPFIND") {
+			t.Errorf("Expected PROPFIND in Allow, got '%s'", resp.Header.Get("Allow"))
+		}
+	})
+
+	t.Run("MKCOL, PUT and PROPFIND", func(t *testing.T) {
+		resp := davRequest(t, "MKCOL", "/dav/"+dir, "", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+		}
+
+		resp = davRequest(t, "MKCOL", "/dav/"+dir, "", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405 for existing collection, got %d", resp.StatusCode)
+		}
+
+		resp = davRequest(t, "MKCOL", "/dav/missing_parent/child", "", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected status 409 for missing parent, got %d", resp.StatusCode)
+		}
+
+		resp = davRequest(t, "PUT", "/dav/"+dir+"/notes.txt", "dav content", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+		}
+
+		code, status := propfind(t, "/dav/"+dir+"/", "1")
+		if code != http.StatusMultiStatus {
+			t.Fatalf("Expected status 207, got %d", code)
+		}
+		if len(status.Responses) != 2 {
+			t.Fatalf("Expected collection and one file, got %d responses", len(status.Responses))
+		}
+		if status.Responses[0].ResourceType.Collection == nil {
+			t.Errorf("Expected first response to be the collection")
+		}
+		file := status.Responses[1]
+		if file.Href != "/dav/"+dir+"/notes.txt" || file.ContentLength != "11" {
+			t.Errorf("Unexpected file entry: %s (%s bytes)", file.Href, file.ContentLength)
+		}
+
+		resp = davRequest(t, "GET", "/dav/"+dir+"/notes.txt", "", nil)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "dav content" {
+			t.Errorf("Expected 'dav content', got '%s'", body)
+		}
+	})
+
+	t.Run("PROPFIND of a missing resource returns 404", func(t *testing.T) {
+		if code, _ := propfind(t, "/dav/"+dir+"/nope.txt", "0"); code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", code)
+		}
+	})
+
+	t.Run("LOCK returns a token", func(t *testing.T) {
+		resp := davRequest(t, "LOCK", "/dav/"+dir+"/notes.txt", `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"/>`, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Lock-Token"), "<opaquelocktoken:") {
+			t.Errorf("Expected Lock-Token header, got '%s'", resp.Header.Get("Lock-Token"))
+		}
+	})
+
+	t.Run("MOVE renames files and collections", func(t *testing.T) {
+		resp := davRequest(t, "MOVE", "/dav/"+dir+"/notes.txt", "", map[string]string{
+			"Destination": "http://localhost:8080/dav/" + dir + "/renamed.txt",
+		})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+		}
+
+		resp = davRequest(t, "MOVE", "/dav/"+dir, "", map[string]string{
+			"Destination": "/dav/" + dir + "_moved",
+		})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+		}
+
+		if code, _ := propfind(t, "/dav/"+dir+"_moved/renamed.txt", "0"); code != http.StatusMultiStatus {
+			t.Errorf("Expected moved file to exist, got %d", code)
+		}
+		if code, _ := propfind(t, "/dav/"+dir, "0"); code != http.StatusNotFound {
+			t.Errorf("Expected source collection to be gone, got %d", code)
+		}
+	})
+
+	t.Run("DELETE removes a collection", func(t *testing.T) {
+		resp := davRequest(t, "DELETE", "/dav/"+dir+"_moved", "", nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if code, _ := propfind(t, "/dav/"+dir+"_moved", "0"); code != http.StatusNotFound {
+			t.Errorf("Expected collection to be gone, got %d", code)
+		}
+	})
+}
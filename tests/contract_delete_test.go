@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type deleteResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+func bulkDelete(t *testing.T, body string) (int, []deleteResult) {
+	t.Helper()
+
+	resp, err := http.Post("http://localhost:8080/files/delete", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Results []deleteResult `json:"results"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+	return resp.StatusCode, result.Results
+}
+
+// TestFileDelete tests DELETE /files/{name} and POST /files/delete
+func TestFileDelete(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	t.Run("DELETE removes the file", func(t *testing.T) {
+		stored := uploadRaw(t, "delete_me.txt", "bye")
+
+		req, err := http.NewRequest(http.MethodDelete, "http://localhost:8080/files/"+stored, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if !strings.Contains(string(body), "File deleted") {
+			t.Errorf("Expected deletion message, got: %s", string(body))
+		}
+
+		resp, err = http.Get("http://localhost:8080/files/" + stored)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404 after delete, got %d", resp.StatusCode)
+		}
+
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404 deleting twice, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("bulk delete by names returns per-file results", func(t *testing.T) {
+		first := uploadRaw(t, "bulk_one.txt", "1")
+		second := uploadRaw(t, "bulk_two.txt", "2")
+
+		body, _ := json.Marshal(map[string][]string{"names": {first, second, "20000101_000000_missing.txt", "../etc/passwd"}})
+		status, results := bulkDelete(t, string(body))
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+
+		want := []string{"deleted", "deleted", "not_found", "invalid"}
+		if len(results) != len(want) {
+			t.Fatalf("Expected %d results, got %d", len(want), len(results))
+		}
+		for i, result := range results {
+			if result.Status != want[i] {
+				t.Errorf("Expected status %s for %s, got %s", want[i], result.Name, result.Status)
+			}
+		}
+	})
+
+	t.Run("bulk delete by pattern", func(t *testing.T) {
+		stored := uploadRaw(t, "bulk_pattern_unique.log", "log")
+		keep := uploadRaw(t, "bulk_pattern_keep.txt", "keep")
+
+		status, results := bulkDelete(t, `{"pattern": "*_bulk_pattern_unique.log"}`)
+		if status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+		if len(results) != 1 || results[0].Name != stored || results[0].Status != "deleted" {
+			t.Errorf("Expected only %s deleted, got %+v", stored, results)
+		}
+
+		resp, err := http.Head("http://localhost:8080/files/" + keep)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected non-matching file to remain, got status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("bulk delete without criteria returns 400", func(t *testing.T) {
+		for _, body := range []string{`{}`, `not json`, `{"pattern": "["}`} {
+			status, _ := bulkDelete(t, body)
+			if status != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for %s, got %d", body, status)
+			}
+		}
+	})
+
+	t.Run("GET /files/delete returns 405", func(t *testing.T) {
+		resp, err := http.Get("http://localhost:8080/files/delete")
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestFileDownload tests the GET /files/{name} endpoint
+func TestFileDownload(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	content := "0123456789abcdef"
+	stored := uploadRaw(t, "download.txt", content)
+	fileURL := "http://localhost:8080/files/" + stored
+
+	t.Run("GET returns file with headers", func(t *testing.T) {
+		resp, err := http.Get(fileURL)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if string(body) != content {
+			t.Errorf("Expected body '%s', got '%s'", content, string(body))
+		}
+
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			t.Errorf("Expected text/plain Content-Type, got '%s'", resp.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(resp.Header.Get("Content-Disposition"), `filename=download.txt`) {
+			t.Errorf("Expected original filename in Content-Disposition, got '%s'", resp.Header.Get("Content-Disposition"))
+		}
+		if resp.Header.Get("ETag") == "" || resp.Header.Get("Last-Modified") == "" {
+			t.Errorf("Expected ETag and Last-Modified headers")
+		}
+	})
+
+	t.Run("active content is never rendered inline", func(t *testing.T) {
+		stored := uploadRaw(t, "page.html", "<html><script>alert(document.cookie)</script></html>")
+		resp, err := http.Get("http://localhost:8080/files/" + stored)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if !strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment") {
+			t.Errorf("Expected an attachment, got '%s'", resp.Header.Get("Content-Disposition"))
+		}
+		if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("Expected X-Content-Type-Options: nosniff, got '%s'", resp.Header.Get("X-Content-Type-Options"))
+		}
+	})
+
+	t.Run("Range request returns 206 Partial Content", func(t *testing.T) {
+		req, err := http.NewRequest("GET", fileURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Range", "bytes=10-")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Errorf("Expected status 206, got %d", resp.StatusCode)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "abcdef" {
+			t.Errorf("Expected 'abcdef', got '%s'", string(body))
+		}
+	})
+
+	t.Run("If-None-Match with current ETag returns 304", func(t *testing.T) {
+		resp, err := http.Head(fileURL)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+
+		req, err := http.NewRequest("GET", fileURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("If-None-Match", etag)
+
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("Expected status 304, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("missing file returns 404", func(t *testing.T) {
+		resp, err := http.Get("http://localhost:8080/files/20000101_000000_missing.txt")
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("path traversal is rejected", func(t *testing.T) {
+		for _, path := range []string{"..%2Fmain.go", "%2E%2E%2F%2E%2E%2Fetc%2Fpasswd", "sub%2Ffile.txt"} {
+			resp, err := http.Get("http://localhost:8080/files/" + path)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			resp.Body.Close()
+
+			// Either rejected by name validation or cleaned away by the router
+			if resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusNotFound {
+				t.Errorf("Expected status 400 or 404 for %s, got %d", path, resp.StatusCode)
+			}
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type listedFile struct {
+	StoredName       string    `json:"stored_name"`
+	Filename         string    `json:"filename"`
+	OriginalFilename string    `json:"original_filename"`
+	Size             int64     `json:"size"`
+	Timestamp        time.Time `json:"timestamp"`
+	MimeType         string    `json:"mime_type"`
+	DetectedMimeType string    `json:"detected_mime_type"`
+	SHA256           string    `json:"sha256"`
+	Origin           *struct {
+		Protocol  string            `json:"protocol"`
+		ClientIP  string            `json:"client_ip"`
+		UserAgent string            `json:"user_agent"`
+		Headers   map[string]string `json:"headers"`
+	} `json:"origin"`
+}
+
+type fileListResponse struct {
+	Files  []listedFile `json:"files"`
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+}
+
+// uploadRaw uploads content under name and returns the stored name
+func uploadRaw(t *testing.T, name, content string) string {
+	t.Helper()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/upload", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Filename", name)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to upload %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Upload of %s failed with status %d", name, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return strings.TrimPrefix(string(body), "File uploaded successfully: ")
+}
+
+func listFiles(t *testing.T, query string) fileListResponse {
+	t.Helper()
+
+	resp, err := http.Get("http://localhost:8080/files?" + query)
+	if err != nil {
+		t.Fatalf("Failed to list files: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "application/json") {
+		t.Errorf("Expected JSON Content-Type, got '%s'", resp.Header.Get("Content-Type"))
+	}
+
+	var list fileListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode listing: %v", err)
+	}
+	return list
+}
+
+// TestFilesListing tests the GET /files endpoint
+func TestFilesListing(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	stored := uploadRaw(t, "listing test.csv", "a,b,c")
+
+	t.Run("uploaded file appears with parsed metadata", func(t *testing.T) {
+		list := listFiles(t, "limit=1000")
+
+		var found *listedFile
+		for i := range list.Files {
+			if list.Files[i].StoredName == stored {
+				found = &list.Files[i]
+			}
+		}
+		if found == nil {
+			t.Fatalf("Expected %s in listing", stored)
+		}
+		if found.Filename != "listing_test.csv" {
+			t.Errorf("Expected original name 'listing_test.csv', got '%s'", found.Filename)
+		}
+		if found.Size != 5 {
+			t.Errorf("Expected size 5, got %d", found.Size)
+		}
+		if !strings.HasPrefix(found.MimeType, "text/csv") {
+			t.Errorf("Expected text/csv MIME type, got '%s'", found.MimeType)
+		}
+		if time.Since(found.Timestamp) > time.Minute {
+			t.Errorf("Expected recent timestamp, got %v", found.Timestamp)
+		}
+	})
+
+	t.Run("prefix filter and pagination", func(t *testing.T) {
+		list := listFiles(t, "prefix="+stored+"&limit=1")
+		if list.Total != 1 || len(list.Files) != 1 {
+			t.Errorf("Expected exactly one match, got total=%d files=%d", list.Total, len(list.Files))
+		}
+
+		list = listFiles(t, "prefix="+stored+"&offset=1")
+		if len(list.Files) != 0 {
+			t.Errorf("Expected empty page past the end, got %d files", len(list.Files))
+		}
+	})
+
+	t.Run("sort by size ascending", func(t *testing.T) {
+		list := listFiles(t, "sort=size&order=asc&limit=1000")
+		for i := 1; i < len(list.Files); i++ {
+			if list.Files[i-1].Size > list.Files[i].Size {
+				t.Fatalf("Files not sorted by size: %d before %d", list.Files[i-1].Size, list.Files[i].Size)
+			}
+		}
+	})
+
+	t.Run("filters by tag, size, type and time", func(t *testing.T) {
+		tag := "listing-" + time.Now().Format("150405.000000")
+		start := time.Now().Add(-time.Second)
+
+		req, _ := http.NewRequest("POST", "http://localhost:8080/upload", strings.NewReader("\x89PNG\r\n\x1a\n"+strings.Repeat("x", 100)))
+		req.Header.Set("X-Filename", "tagged.png")
+		req.Header.Set("X-Tags", tag+", images")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		image := strings.TrimPrefix(string(body), "File uploaded successfully: ")
+
+		list := listFiles(t, "tag="+tag)
+		if list.Total != 1 || list.Files[0].StoredName != image {
+			t.Fatalf("Expected only %s for tag %s, got %+v", image, tag, list.Files)
+		}
+
+		if list.Files[0].Origin == nil {
+			t.Fatalf("Expected origin to be recorded")
+		}
+		uploader := list.Files[0].Origin.ClientIP
+
+		for _, query := range []string{"min_size=100", "type=image/*", "after=" + start.UTC().Format(time.RFC3339), "uploader=" + uploader} {
+			if list := listFiles(t, "tag="+tag+"&"+query); list.Total != 1 {
+				t.Errorf("Expected the tagged file to match %s, got %d", query, list.Total)
+			}
+		}
+		for _, query := range []string{"max_size=50", "type=text/*", "before=" + start.UTC().Format(time.RFC3339), "uploader=nobody"} {
+			if list := listFiles(t, "tag="+tag+"&"+query); list.Total != 0 {
+				t.Errorf("Expected no match for %s, got %d", query, list.Total)
+			}
+		}
+	})
+
+	t.Run("invalid parameters return 400", func(t *testing.T) {
+		for _, query := range []string{"sort=color", "order=sideways", "limit=0", "offset=-1", "after=yesterday", "min_size=-1"} {
+			resp, err := http.Get("http://localhost:8080/files?" + query)
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for %s, got %d", query, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("POST /files returns 405 Method Not Allowed", func(t *testing.T) {
+		resp, err := http.Post("http://localhost:8080/files", "text/plain", strings.NewReader("test"))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status 405, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type storedFile struct {
+	Filename   string    `json:"filename"`
+	StoredName string    `json:"stored_name"`
+	Size       int64     `json:"size"`
+	MimeType   string    `json:"mime_type"`
+	SHA256     string    `json:"sha256"`
+	MD5        string    `json:"md5"`
+	CRC32C     string    `json:"crc32c"`
+	Timestamp  time.Time `json:"timestamp"`
+	Status     int       `json:"status"`
+	Error      *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// TestJSONResponses tests content negotiation with Accept: application/json
+func TestJSONResponses(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	t.Run("upload returns stored file document", func(t *testing.T) {
+		content := "json upload content"
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, err := writer.CreateFormFile("file", "data file.json")
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		part.Write([]byte(content))
+		writer.Close()
+
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload", &body)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			t.Errorf("Expected JSON Content-Type, got '%s'", resp.Header.Get("Content-Type"))
+		}
+
+		var result struct {
+			Files []storedFile `json:"files"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(result.Files) != 1 {
+			t.Fatalf("Expected one file result, got %d", len(result.Files))
+		}
+
+		file := result.Files[0]
+		sum := sha256.Sum256([]byte(content))
+		if file.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected sha256 %x, got %s", sum, file.SHA256)
+		}
+		if file.Filename != "data file.json" || !strings.HasSuffix(file.StoredName, "data_file.json") {
+			t.Errorf("Unexpected names: filename=%s stored_name=%s", file.Filename, file.StoredName)
+		}
+		if file.Size != int64(len(content)) {
+			t.Errorf("Expected size %d, got %d", len(content), file.Size)
+		}
+		if file.MimeType != "application/json" {
+			t.Errorf("Expected mime_type application/json, got %s", file.MimeType)
+		}
+		if time.Since(file.Timestamp) > time.Minute {
+			t.Errorf("Expected recent timestamp, got %v", file.Timestamp)
+		}
+	})
+
+	t.Run("errors are returned as objects with codes", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload", strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+
+		var result struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode error: %v", err)
+		}
+		if result.Error.Code != "no_file" || result.Error.Message == "" {
+			t.Errorf("Expected no_file error with message, got %+v", result.Error)
+		}
+	})
+
+	t.Run("wildcard Accept keeps plain text", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload", strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Filename", "plain.txt")
+		req.Header.Set("Accept", "*/*")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			t.Errorf("Expected text/plain Content-Type, got '%s'", resp.Header.Get("Content-Type"))
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestUploadMetadata tests that upload metadata shows up in listings and
+// downloads
+func TestUploadMetadata(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	content := "%PDF-1.4 metadata test"
+	req, _ := http.NewRequest("POST", "http://localhost:8080/upload", strings.NewReader(content))
+	req.Header.Set("X-Filename", "Quarterly report (final).pdf")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("User-Agent", "metadata-test/1.0")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	stored := strings.TrimPrefix(string(body), "File uploaded successfully: ")
+	t.Cleanup(func() {
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080/files/"+stored, nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	})
+	sum := sha256.Sum256([]byte(content))
+
+	t.Run("listing includes recorded metadata", func(t *testing.T) {
+		list := listFiles(t, "prefix="+url.QueryEscape(stored))
+		if len(list.Files) != 1 {
+			t.Fatalf("Expected 1 file, got %d", len(list.Files))
+		}
+		file := list.Files[0]
+		if file.OriginalFilename != "Quarterly report (final).pdf" {
+			t.Errorf("Expected original filename, got '%s'", file.OriginalFilename)
+		}
+		if file.MimeType != "application/pdf" {
+			t.Errorf("Expected MIME type application/pdf, got '%s'", file.MimeType)
+		}
+		if file.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected sha256 %x, got '%s'", sum, file.SHA256)
+		}
+		if file.DetectedMimeType != "application/pdf" {
+			t.Errorf("Expected detected type application/pdf, got '%s'", file.DetectedMimeType)
+		}
+		if file.Origin == nil {
+			t.Fatalf("Expected origin to be recorded")
+		}
+		if file.Origin.Protocol != "upload" || file.Origin.UserAgent != "metadata-test/1.0" {
+			t.Errorf("Unexpected origin: %+v", file.Origin)
+		}
+		if file.Origin.ClientIP == "" || file.Origin.Headers["X-Forwarded-For"] != "203.0.113.7" {
+			t.Errorf("Expected client IP and forwarding headers, got %+v", file.Origin)
+		}
+	})
+
+	t.Run("download carries the recorded digest", func(t *testing.T) {
+		resp, err := http.Get("http://localhost:8080/files/" + stored)
+		if err != nil {
+			t.Fatalf("Failed to download: %v", err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Content-Type") != "application/pdf" {
+			t.Errorf("Expected Content-Type application/pdf, got '%s'", resp.Header.Get("Content-Type"))
+		}
+		want := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+		if resp.Header.Get("Repr-Digest") != want {
+			t.Errorf("Expected Repr-Digest %s, got '%s'", want, resp.Header.Get("Repr-Digest"))
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putFile(t *testing.T, name, content string, headers map[string]string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest("PUT", "http://localhost:8080/files/"+name, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func getContent(t *testing.T, name string) string {
+	t.Helper()
+
+	resp, err := http.Get("http://localhost:8080/files/" + name)
+	if err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+// TestPutUpload tests the PUT /files/{name} endpoint
+func TestPutUpload(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	name := "put_" + time.Now().Format("150405.000000") + ".txt"
+	t.Cleanup(func() {
+		req, _ := http.NewRequest("DELETE", "http://localhost:8080/files/"+name, nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	})
+
+	t.Run("PUT creates a file under the given name", func(t *testing.T) {
+		resp := putFile(t, name, "first", nil)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get("Location") != "/files/"+name {
+			t.Errorf("Expected Location /files/%s, got '%s'", name, resp.Header.Get("Location"))
+		}
+		if body := getContent(t, name); body != "first" {
+			t.Errorf("Expected 'first', got '%s'", body)
+		}
+	})
+
+	t.Run("PUT overwrites by default", func(t *testing.T) {
+		resp := putFile(t, name, "second", nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if body := getContent(t, name); body != "second" {
+			t.Errorf("Expected 'second', got '%s'", body)
+		}
+	})
+
+	t.Run("If-None-Match: * refuses to overwrite", func(t *testing.T) {
+		resp := putFile(t, name, "third", map[string]string{"If-None-Match": "*"})
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			t.Fatalf("Expected status 412, got %d", resp.StatusCode)
+		}
+		if body := getContent(t, name); body != "second" {
+			t.Errorf("Expected 'second' to be kept, got '%s'", body)
+		}
+	})
+
+	t.Run("Name is sanitized", func(t *testing.T) {
+		resp := putFile(t, "put%20with%20spaces.txt", "spaces", nil)
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 201 or 200, got %d", resp.StatusCode)
+		}
+		if body := getContent(t, "put_with_spaces.txt"); body != "spaces" {
+			t.Errorf("Expected file under sanitized name, got '%s'", body)
+		}
+	})
+
+	t.Run("Hidden names are rejected", func(t *testing.T) {
+		if resp := putFile(t, ".hidden", "x", nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Expect: 100-continue is rejected before the body is sent", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost:8080")
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// Far larger than MAX_SIZE; the body is never sent
+		io.WriteString(conn, "PUT /files/too_big.bin HTTP/1.1\r\nHost: localhost\r\n"+
+			"Content-Length: 10737418240\r\nExpect: 100-continue\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413 instead of 100 Continue, got %d", resp.StatusCode)
+		}
+	})
+}
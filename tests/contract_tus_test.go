@@ -0,0 +1,194 @@
+package tests
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tusRequest sends a tus request with the protocol version header set
+func tusRequest(t *testing.T, method, url string, body io.Reader, headers map[string]string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	return resp
+}
+
+// createTusUpload creates an upload of the given length and returns its URL
+func createTusUpload(t *testing.T, filename string, length int) string {
+	t.Helper()
+
+	resp := tusRequest(t, "POST", "http://localhost:8080/tus/", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	})
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/tus/") {
+		t.Fatalf("Expected Location under /tus/, got '%s'", location)
+	}
+	return "http://localhost:8080" + location
+}
+
+func patchTus(t *testing.T, url string, offset int, chunk string) *http.Response {
+	t.Helper()
+
+	resp := tusRequest(t, "PATCH", url, strings.NewReader(chunk), map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	})
+	resp.Body.Close()
+	return resp
+}
+
+// TestTusUpload tests the tus 1.0 resumable upload endpoints under /tus/
+func TestTusUpload(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	t.Run("OPTIONS advertises protocol support", func(t *testing.T) {
+		req, _ := http.NewRequest("OPTIONS", "http://localhost:8080/tus/", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get("Tus-Version") != "1.0.0" {
+			t.Errorf("Expected Tus-Version 1.0.0, got '%s'", resp.Header.Get("Tus-Version"))
+		}
+		for _, ext := range []string{"creation", "expiration", "termination"} {
+			if !strings.Contains(resp.Header.Get("Tus-Extension"), ext) {
+				t.Errorf("Expected Tus-Extension to include %s, got '%s'", ext, resp.Header.Get("Tus-Extension"))
+			}
+		}
+	})
+
+	t.Run("Upload in chunks and resume from HEAD offset", func(t *testing.T) {
+		content := "hello resumable world"
+		url := createTusUpload(t, "resumable.txt", len(content))
+
+		resp := patchTus(t, url, 0, content[:6])
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get("Upload-Offset") != "6" {
+			t.Errorf("Expected Upload-Offset 6, got '%s'", resp.Header.Get("Upload-Offset"))
+		}
+
+		resp = tusRequest(t, "HEAD", url, nil, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if resp.Header.Get("Upload-Offset") != "6" || resp.Header.Get("Upload-Length") != strconv.Itoa(len(content)) {
+			t.Errorf("Unexpected offset/length: %s/%s", resp.Header.Get("Upload-Offset"), resp.Header.Get("Upload-Length"))
+		}
+		if resp.Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("Expected Cache-Control no-store, got '%s'", resp.Header.Get("Cache-Control"))
+		}
+
+		resp = patchTus(t, url, 6, content[6:])
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+		}
+		stored := resp.Header.Get("X-Stored-Name")
+		if !strings.HasSuffix(stored, "_resumable.txt") {
+			t.Fatalf("Expected stored name ending in _resumable.txt, got '%s'", stored)
+		}
+
+		download, err := http.Get("http://localhost:8080/files/" + stored)
+		if err != nil {
+			t.Fatalf("Failed to download: %v", err)
+		}
+		defer download.Body.Close()
+		body, _ := io.ReadAll(download.Body)
+		if string(body) != content {
+			t.Errorf("Expected body '%s', got '%s'", content, string(body))
+		}
+	})
+
+	t.Run("PATCH with wrong offset returns 409", func(t *testing.T) {
+		url := createTusUpload(t, "conflict.txt", 10)
+		if resp := patchTus(t, url, 5, "12345"); resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected status 409, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("PATCH with wrong Content-Type returns 415", func(t *testing.T) {
+		url := createTusUpload(t, "type.txt", 5)
+		resp := tusRequest(t, "PATCH", url, strings.NewReader("12345"), map[string]string{
+			"Content-Type":  "text/plain",
+			"Upload-Offset": "0",
+		})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected status 415, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Missing Tus-Resumable returns 412", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "http://localhost:8080/tus/", nil)
+		req.Header.Set("Upload-Length", "5")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("Expected status 412, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Upload-Length over the limit returns 413", func(t *testing.T) {
+		resp := tusRequest(t, "POST", "http://localhost:8080/tus/", nil, map[string]string{
+			"Upload-Length": "1099511627776",
+		})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("DELETE terminates the upload", func(t *testing.T) {
+		url := createTusUpload(t, "terminate.txt", 10)
+
+		resp := tusRequest(t, "DELETE", url, nil, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+		}
+
+		resp = tusRequest(t, "HEAD", url, nil, nil)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", resp.StatusCode)
+		}
+	})
+}
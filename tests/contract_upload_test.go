@@ -249,4 +249,78 @@ func TestUploadFilenameWithSpecialCharacters(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+// TestRawUpload tests POST /upload with a raw body and X-Filename header
+func TestRawUpload(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	t.Run("octet-stream body with X-Filename returns 200 OK", func(t *testing.T) {
+		// Simulate: curl --data-binary @raw.txt -H "X-Filename: raw.txt"
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload", strings.NewReader("raw body content"))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Filename", "raw test.txt")
+
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+
+		// Filename is sanitized the same way as multipart uploads
+		message := string(respBody)
+		if !strings.Contains(message, "File uploaded successfully") || !strings.Contains(message, "raw_test.txt") {
+			t.Errorf("Expected success message with sanitized filename, got: %s", message)
+		}
+	})
+
+	t.Run("missing X-Filename returns 400 Bad Request", func(t *testing.T) {
+		resp, err := http.Post("http://localhost:8080/upload", "application/octet-stream", strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("raw body too large returns 413", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "http://localhost:8080/upload", bytes.NewReader(make([]byte, 11*1024*1024)))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Filename", "too_large.bin")
+
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d", resp.StatusCode)
+		}
+	})
+}
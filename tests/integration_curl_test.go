@@ -299,4 +299,90 @@ func TestCurlLargeFileUpload(t *testing.T) {
 			t.Errorf("Large file upload took too long: %v", elapsed)
 		}
 	})
-}
\ No newline at end of file
+}
+
+// TestCurlMultipleFilesUpload tests sending several files in one request
+func TestCurlMultipleFilesUpload(t *testing.T) {
+	// Skip if server is not running
+	resp, err := http.Get("http://localhost:8080/health")
+	if err != nil {
+		t.Skip("Server not running on localhost:8080, skipping integration tests")
+	}
+	resp.Body.Close()
+
+	t.Run("all files stored with one result line each", func(t *testing.T) {
+		// Simulate: curl -F "file=@bundle_0.log" ... -F "file=@bundle_24.log"
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+
+		numFiles := 25
+		for i := 0; i < numFiles; i++ {
+			fileWriter, err := writer.CreateFormFile("file", fmt.Sprintf("bundle_%d.log", i))
+			if err != nil {
+				t.Fatalf("Failed to create form file: %v", err)
+			}
+			fmt.Fprintf(fileWriter, "log line %d", i)
+		}
+		writer.WriteField("comment", "plain fields are ignored")
+		writer.Close()
+
+		resp, err := http.Post("http://localhost:8080/upload", writer.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		lines := strings.Split(string(respBody), "\n")
+		if len(lines) != numFiles {
+			t.Fatalf("Expected %d result lines, got %d: %s", numFiles, len(lines), respBody)
+		}
+		for i, line := range lines {
+			if !strings.Contains(line, "File uploaded successfully") || !strings.Contains(line, fmt.Sprintf("bundle_%d.log", i)) {
+				t.Errorf("Unexpected result line %d: %s", i, line)
+			}
+		}
+	})
+
+	t.Run("oversized file fails alone with 207 Multi-Status", func(t *testing.T) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+
+		small, _ := writer.CreateFormFile("file", "small.txt")
+		io.WriteString(small, "small")
+		large, _ := writer.CreateFormFile("file", "huge.bin")
+		large.Write(make([]byte, 11*1024*1024))
+		after, _ := writer.CreateFormFile("file", "after.txt")
+		io.WriteString(after, "after")
+		writer.Close()
+
+		resp, err := http.Post("http://localhost:8080/upload", writer.FormDataContentType(), &body)
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMultiStatus {
+			t.Errorf("Expected status 207, got %d", resp.StatusCode)
+		}
+
+		respBody, _ := io.ReadAll(resp.Body)
+		lines := strings.Split(string(respBody), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("Expected 3 result lines, got: %s", respBody)
+		}
+		if !strings.Contains(lines[0], "small.txt") || !strings.Contains(lines[2], "after.txt") {
+			t.Errorf("Expected small.txt and after.txt to succeed, got: %s", respBody)
+		}
+		if !strings.Contains(lines[1], "Failed to upload huge.bin: File too large") {
+			t.Errorf("Expected huge.bin to fail as too large, got: %s", lines[1])
+		}
+	})
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tusVersion is the only tus protocol version supported.
+const tusVersion = "1.0.0"
+
+// tusExtensions lists the tus extensions implemented on top of the core
+// protocol.
+const tusExtensions = "creation,expiration,termination"
+
+// uploadIDPattern matches the IDs given to tus and chunked uploads.
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// tusUpload is the persisted state of a resumable upload. The received
+// bytes live next to it in {id}.bin; the offset is that file's size.
+// Prefix is the creating token's prefix, which the file is stored below.
+type tusUpload struct {
+	ID         string    `json:"id"`
+	Length     int64     `json:"length"`
+	Filename   string    `json:"filename"`
+	FileType   string    `json:"filetype,omitempty"`
+	Prefix     string    `json:"prefix,omitempty"`
+	Expires    time.Time `json:"expires"`
+	StoredName string    `json:"stored_name,omitempty"`
+}
+
+// tusHandler implements the tus 1.0 resumable upload protocol under /tus/.
+// Partial uploads are kept in dir; once complete they are moved into
+// storage with the same naming as uploadHandler.
+type tusHandler struct {
+	dir          string
+	store        Storage
+	names        *namer
+	types        *typePolicy
+	maxSizeBytes int64
+	expiry       time.Duration
+
+	// locks holds a *sync.Mutex per upload ID so PATCHes don't interleave
+	locks sync.Map
+}
+
+func newTusHandler(dir string, store Storage, names *namer, types *typePolicy, maxSizeBytes int64, expiry time.Duration) (*tusHandler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &tusHandler{dir: dir, store: store, names: names, types: types, maxSizeBytes: maxSizeBytes, expiry: expiry}
+	h.removeExpired()
+	return h, nil
+}
+
+func (h *tusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxSizeBytes, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, r, http.StatusPreconditionFailed, codeInvalidRequest, "Unsupported tus version")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tus"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+			return
+		}
+		h.create(w, r)
+		return
+	}
+	if !uploadIDPattern.MatchString(id) {
+		writeError(w, r, http.StatusNotFound, codeNotFound, "Upload not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		h.head(w, r, id)
+	case http.MethodPatch:
+		h.patch(w, r, id)
+	case http.MethodDelete:
+		h.terminate(w, r, id)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// create handles POST /tus/ (creation extension).
+func (h *tusHandler) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Missing or invalid Upload-Length")
+		return
+	}
+	if length > h.maxSizeBytes {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeFileTooLarge, "File too large")
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Invalid Upload-Metadata")
+		return
+	}
+
+	// Creation is infrequent, so it's a convenient time to clean up
+	h.removeExpired()
+
+	upload := &tusUpload{
+		ID:       randomHex(16),
+		Length:   length,
+		Filename: firstNonEmpty(metadata["filename"], metadata["name"]),
+		FileType: firstNonEmpty(metadata["filetype"], metadata["type"]),
+		Expires:  time.Now().Add(h.expiry),
+	}
+	if token := requestToken(r); token != nil {
+		upload.Prefix = token.Prefix
+	}
+	if err := h.types.check("", upload.FileType, upload.Filename); err != nil {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, err.Error())
+		return
+	}
+	if err := os.WriteFile(h.dataPath(upload.ID), nil, 0644); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to create upload")
+		log.Printf("Failed to create tus upload: %v", err)
+		return
+	}
+	if err := h.save(upload); err != nil {
+		os.Remove(h.dataPath(upload.ID))
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to create upload")
+		log.Printf("Failed to create tus upload: %v", err)
+		return
+	}
+
+	// Zero-length uploads are complete as soon as they exist
+	if length == 0 {
+		if !h.finish(w, r, upload) {
+			return
+		}
+	}
+
+	log.Printf("Resumable upload created: %s (%s, %d bytes)", upload.ID, upload.Filename, length)
+	w.Header().Set("Location", "/tus/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// head handles HEAD /tus/{id}, reporting how much has been received.
+func (h *tusHandler) head(w http.ResponseWriter, r *http.Request, id string) {
+	upload, offset, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	if upload.StoredName != "" {
+		w.Header().Set("X-Stored-Name", upload.StoredName)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// patch handles PATCH /tus/{id}, appending the body at Upload-Offset. When
+// the last byte arrives the file is moved into storage.
+func (h *tusHandler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	lock, _ := h.locks.LoadOrStore(id, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		writeError(w, r, http.StatusConflict, codeConflict, "Upload is already being written to")
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	upload, offset, ok := h.load(w, r, id)
+	if !ok {
+		return
+	}
+	if upload.StoredName != "" {
+		writeError(w, r, http.StatusConflict, codeConflict, "Upload is already complete")
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Missing or invalid Upload-Offset")
+		return
+	}
+	if clientOffset != offset {
+		writeError(w, r, http.StatusConflict, codeConflict, fmt.Sprintf("Upload-Offset %d does not match current offset %d", clientOffset, offset))
+		return
+	}
+
+	f, err := os.OpenFile(h.dataPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to write upload")
+		log.Printf("Failed to open tus upload %s: %v", id, err)
+		return
+	}
+	// Whatever arrives before a disconnect is kept, which is what makes the
+	// upload resumable
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	syncErr := f.Sync()
+	f.Close()
+	if copyErr != nil || syncErr != nil {
+		log.Printf("Tus upload %s interrupted at offset %d: %v", id, offset+n, errors.Join(copyErr, syncErr))
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to write upload")
+		return
+	}
+	offset += n
+
+	upload.Expires = time.Now().Add(h.expiry)
+	if offset == upload.Length {
+		if !h.finish(w, r, upload) {
+			return
+		}
+	} else if err := h.save(upload); err != nil {
+		log.Printf("Failed to update tus upload %s: %v", id, err)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish moves a complete upload into storage and records its stored name,
+// writing an error response and returning false on failure. It is named
+// for the token that created the upload, not the one sending the last
+// PATCH.
+func (h *tusHandler) finish(w http.ResponseWriter, r *http.Request, upload *tusUpload) bool {
+	f, err := os.Open(h.dataPath(upload.ID))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to save file")
+		log.Printf("Failed to open tus upload %s: %v", upload.ID, err)
+		return false
+	}
+	names := h.names
+	if upload.Prefix != "" {
+		names = names.under(upload.Prefix)
+	}
+	result := storeFile(h.store, names, h.types, upload.Filename, upload.FileType, newChecksumReader(f, nil, nil), requestOrigin(r, "tus"))
+	f.Close()
+	if result.Error != nil {
+		writeError(w, r, result.Status, result.Error.Code, result.Error.Message)
+		return false
+	}
+
+	// Keep the record until it expires so HEAD still reports completion
+	upload.StoredName = result.StoredName
+	os.Remove(h.dataPath(upload.ID))
+	if err := h.save(upload); err != nil {
+		log.Printf("Failed to update tus upload %s: %v", upload.ID, err)
+	}
+	w.Header().Set("X-Stored-Name", upload.StoredName)
+	return true
+}
+
+// terminate handles DELETE /tus/{id} (termination extension).
+func (h *tusHandler) terminate(w http.ResponseWriter, r *http.Request, id string) {
+	if _, _, ok := h.load(w, r, id); !ok {
+		return
+	}
+	h.remove(id)
+	log.Printf("Resumable upload terminated: %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// load reads an upload and its current offset, writing 404 or 410 if it is
+// missing or expired.
+func (h *tusHandler) load(w http.ResponseWriter, r *http.Request, id string) (*tusUpload, int64, bool) {
+	data, err := os.ReadFile(h.infoPath(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, r, http.StatusNotFound, codeNotFound, "Upload not found")
+		} else {
+			writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to read upload")
+			log.Printf("Failed to read tus upload %s: %v", id, err)
+		}
+		return nil, 0, false
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to read upload")
+		log.Printf("Corrupt tus upload %s: %v", id, err)
+		return nil, 0, false
+	}
+	if time.Now().After(upload.Expires) {
+		h.remove(id)
+		writeError(w, r, http.StatusGone, codeNotFound, "Upload expired")
+		return nil, 0, false
+	}
+
+	if upload.StoredName != "" {
+		return &upload, upload.Length, true
+	}
+	info, err := os.Stat(h.dataPath(id))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, codeStorageError, "Failed to read upload")
+		log.Printf("Failed to stat tus upload %s: %v", id, err)
+		return nil, 0, false
+	}
+	return &upload, info.Size(), true
+}
+
+// save writes the upload record atomically.
+func (h *tusHandler) save(upload *tusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := h.infoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.infoPath(upload.ID))
+}
+
+func (h *tusHandler) remove(id string) {
+	os.Remove(h.dataPath(id))
+	os.Remove(h.infoPath(id))
+	h.locks.Delete(id)
+}
+
+// removeExpired deletes uploads past their expiry (expiration extension).
+func (h *tusHandler) removeExpired() {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		log.Printf("Failed to list tus uploads: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !uploadIDPattern.MatchString(id) {
+			continue
+		}
+		data, err := os.ReadFile(h.infoPath(id))
+		if err != nil {
+			continue
+		}
+		var upload tusUpload
+		if json.Unmarshal(data, &upload) == nil && time.Now().After(upload.Expires) {
+			h.remove(id)
+			log.Printf("Resumable upload expired: %s", id)
+		}
+	}
+}
+
+func (h *tusHandler) infoPath(id string) string {
+	return filepath.Join(h.dir, id+".json")
+}
+
+func (h *tusHandler) dataPath(id string) string {
+	return filepath.Join(h.dir, id+".bin")
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs, where the value may be omitted.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
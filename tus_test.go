@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTusUploadPrefix(t *testing.T) {
+	store, _ := newFileStorage(t.TempDir())
+	names, _ := newNamer(defaultNameTemplate)
+	tus, err := newTusHandler(filepath.Join(t.TempDir(), ".tus"), store, names, nil, 1024, time.Hour)
+	if err != nil {
+		t.Fatalf("newTusHandler failed: %v", err)
+	}
+	tokens, _ := parseTokens(strings.NewReader("alice alice-secret-0123456789 upload alice; bob bob-secret-0123456789 upload bob"))
+	handler := (&authenticator{tokens: tokens}).middleware(tus)
+
+	do := func(method, target, secret string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+secret)
+		r.Header.Set("Tus-Resumable", tusVersion)
+		if method == http.MethodPost {
+			r.Header.Set("Upload-Length", "5")
+			r.Header.Set("Upload-Metadata", "filename cmVwb3J0LnR4dA==")
+		} else {
+			r.Header.Set("Content-Type", "application/offset+octet-stream")
+			r.Header.Set("Upload-Offset", "0")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do(http.MethodPost, "/tus/", "alice-secret-0123456789", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	target := "/tus/" + location[strings.LastIndex(location, "/")+1:]
+
+	// The last PATCH comes from another token, which doesn't decide the name
+	w = do(http.MethodPatch, target, "bob-secret-0123456789", "hello")
+	if w.Code != http.StatusNoContent || !strings.HasPrefix(w.Header().Get("X-Stored-Name"), "alice/") {
+		t.Errorf("Expected the upload stored below alice/, got %d %q", w.Code, w.Header().Get("X-Stored-Name"))
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxNameAttempts bounds how often storeFile picks a new name after a
+// collision.
+const maxNameAttempts = 5
+
+// Limits on a multipart request besides MAX_SIZE per file: plain fields of
+// at most maxFormFieldSize bytes, and no more in total than MAX_SIZE for
+// each file allowed, or maxFormFiles if unlimited, plus maxFormOverhead.
+const (
+	maxFormFiles     = 100
+	maxFormFieldSize = 4096
+	maxFormOverhead  = 1 << 20
+)
+
+// errFileTooLarge is returned while streaming a multipart file part that
+// exceeds MAX_SIZE.
+var errFileTooLarge = errors.New("file too large")
+
+// uploadResult is the outcome of storing one file. Successful results
+// follow the "Stored File" structure in data-model.md.
+type uploadResult struct {
+	Filename         string    `json:"filename"`
+	StoredName       string    `json:"stored_name,omitempty"`
+	Size             int64     `json:"size"`
+	MimeType         string    `json:"mime_type,omitempty"`
+	DetectedMimeType string    `json:"detected_mime_type,omitempty"`
+	SHA256           string    `json:"sha256,omitempty"`
+	MD5              string    `json:"md5,omitempty"`
+	CRC32C           string    `json:"crc32c,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+	Status           int       `json:"status"`
+	Error            *apiError `json:"error,omitempty"`
+}
+
+func uploadHandler(store Storage, names *namer, types *typePolicy, links *uploadLinks, maxSizeBytes int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("sig") {
+			handleLinkUpload(w, r, store, names, types, links, maxSizeBytes)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		// Dispatch on Content-Type: multipart forms from browsers and curl -F,
+		// anything else is treated as the raw file body (curl --data-binary)
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		names := uploadNamer(r, names)
+		if mediaType == "multipart/form-data" {
+			handleMultipartUpload(w, r, store, names, types, maxSizeBytes, 0, 0)
+			return
+		}
+		handleRawUpload(w, r, store, names, types, maxSizeBytes)
+	}
+}
+
+// handleLinkUpload serves a signed upload link: GET shows the upload page,
+// POST stores a single file within the link's limits. The link is checked
+// before the body is read, and can be used again if nothing was stored.
+func handleLinkUpload(w http.ResponseWriter, r *http.Request, store Storage, names *namer, types *typePolicy, links *uploadLinks, maxSizeBytes int64) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	link, ok := links.checkLink(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(indexHTML))
+		return
+	}
+
+	if link.MaxSize > 0 {
+		maxSizeBytes = min(maxSizeBytes, link.MaxSize)
+	}
+	if link.Prefix != "" {
+		names = names.prefixed(link.Prefix)
+	}
+	var results []uploadResult
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		results = handleMultipartUpload(w, r, store, names, types, maxSizeBytes, 1, 0)
+	} else {
+		results = handleRawUpload(w, r, store, names, types, maxSizeBytes)
+	}
+	if !slices.ContainsFunc(results, func(result uploadResult) bool { return result.Error == nil }) {
+		links.release(link)
+	}
+}
+
+// handleMultipartUpload streams every file part of the form to storage in
+// turn, so any number of files can be sent without buffering the request.
+// MAX_SIZE applies to each file separately, and the request as a whole may
+// be as large as maxFiles of them (maxFormFiles if 0) plus the form.
+// Checksums for a file come from its part headers or from sha256, md5 and
+// crc32c fields sent before it. Files beyond maxFiles are refused, as are
+// files that would take the total stored over maxTotalBytes; 0 means no
+// limit for either. It returns the results written, which are empty if the
+// request failed as a whole.
+func handleMultipartUpload(w http.ResponseWriter, r *http.Request, store Storage, names *namer, types *typePolicy, maxSizeBytes int64, maxFiles int, maxTotalBytes int64) []uploadResult {
+	files := int64(maxFiles)
+	if files <= 0 {
+		files = maxFormFiles
+	}
+	total := int64(maxFormOverhead)
+	if maxSizeBytes > 0 {
+		total += min(files, (1<<62)/maxSizeBytes) * maxSizeBytes
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, total)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Failed to parse form")
+		return nil
+	}
+
+	var results []uploadResult
+	var stored int64
+	fields := checksums{}
+	origin := requestOrigin(r, "upload")
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, codeFileTooLarge, "Request too large")
+			return nil
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Failed to parse form")
+			return nil
+		}
+
+		// Remember checksum fields for the next file and tags for the
+		// following ones, skip other plain form fields and empty file inputs
+		if part.FileName() == "" {
+			value, _ := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+			if len(value) > maxFormFieldSize {
+				part.Close()
+				writeError(w, r, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Form field %q is larger than %d bytes", part.FormName(), maxFormFieldSize))
+				return nil
+			}
+			if alg, ok := checksumField[part.FormName()]; ok {
+				err = fields.add(alg, strings.TrimSpace(string(value)))
+			} else if part.FormName() == "tags" {
+				origin.Tags = parseTags(string(value))
+			}
+			part.Close()
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+				return nil
+			}
+			continue
+		}
+
+		expected, err := headerChecksums(http.Header(part.Header))
+		if err == nil {
+			err = expected.merge(fields)
+		}
+		if err != nil {
+			part.Close()
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return nil
+		}
+		fields = checksums{}
+		if maxFiles > 0 && len(results) >= maxFiles {
+			part.Close()
+			results = append(results, uploadResult{Filename: part.FileName(), Status: http.StatusBadRequest,
+				Error: &apiError{Code: codeInvalidRequest, Message: fmt.Sprintf("At most %d file(s) per request", maxFiles)}})
+			continue
+		}
+
+		limit := maxSizeBytes
+		if maxTotalBytes > 0 {
+			limit = min(limit, max(maxTotalBytes-stored, 0))
+		}
+		src := newChecksumReader(&sizeLimitReader{r: part, remaining: limit}, expected, wantedChecksums(r.Header))
+		result := storeFile(store, names, types, part.FileName(), part.Header.Get("Content-Type"), src, origin)
+		if result.Error == nil {
+			stored += result.Size
+		}
+		results = append(results, result)
+		part.Close()
+	}
+
+	if len(results) == 0 {
+		writeError(w, r, http.StatusBadRequest, codeNoFile, "No file provided")
+		return nil
+	}
+	writeUploadResults(w, r, results)
+	return results
+}
+
+func handleRawUpload(w http.ResponseWriter, r *http.Request, store Storage, names *namer, types *typePolicy, maxSizeBytes int64) []uploadResult {
+	// Raw uploads carry the filename in a header since there is no form
+	name := r.Header.Get("X-Filename")
+	if name == "" {
+		writeError(w, r, http.StatusBadRequest, codeNoFile, "No filename provided (set the X-Filename header)")
+		return nil
+	}
+	if err := types.check("", r.Header.Get("Content-Type"), name); err != nil {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, err.Error())
+		return nil
+	}
+
+	expected, err := headerChecksums(r.Header)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return nil
+	}
+
+	src := newChecksumReader(http.MaxBytesReader(w, r.Body, maxSizeBytes), expected, wantedChecksums(r.Header))
+	results := []uploadResult{storeFile(store, names, types, name, r.Header.Get("Content-Type"), src, requestOrigin(r, "upload"))}
+	writeUploadResults(w, r, results)
+	return results
+}
+
+// handlePut stores the body of a PUT to requested under the sanitized name,
+// replacing any existing file unless If-None-Match: * is set. Everything
+// that can be rejected is checked before the body is read, so clients
+// sending Expect: 100-continue never transmit it for nothing. protocol is
+// recorded in the file's metadata.
+func handlePut(w http.ResponseWriter, r *http.Request, store Storage, types *typePolicy, maxSizeBytes int64, requested, protocol string) {
+	name, ok := sanitizeStoredName(requested)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, codeInvalidFilename, "Invalid filename")
+		return
+	}
+	if r.ContentLength > maxSizeBytes {
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeFileTooLarge, "File too large")
+		return
+	}
+	if err := types.check("", r.Header.Get("Content-Type"), name); err != nil {
+		writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, err.Error())
+		return
+	}
+	expected, err := headerChecksums(r.Header)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	overwrite := true
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if strings.TrimSpace(match) != "*" {
+			writeError(w, r, http.StatusBadRequest, codeInvalidRequest, "Only If-None-Match: * is supported")
+			return
+		}
+		overwrite = false
+	}
+	_, err = store.Stat(name)
+	existed := err == nil
+	if existed && !overwrite {
+		writeError(w, r, http.StatusPreconditionFailed, codeConflict, "File already exists")
+		return
+	}
+
+	src := newChecksumReader(http.MaxBytesReader(w, r.Body, maxSizeBytes), expected, wantedChecksums(r.Header))
+	result := putFile(store, types, name, r.Header.Get("Content-Type"), src, overwrite, requestOrigin(r, protocol))
+	if result.Status == http.StatusOK && !existed {
+		result.Status = http.StatusCreated
+		w.Header().Set("Location", "/files/"+name)
+	}
+	writeUploadResults(w, r, []uploadResult{result})
+}
+
+// storeFile streams src into store under a name generated from the name
+// template, retrying with a fresh name if it is already taken. The
+// checksums are computed on the way through, and a file that doesn't match
+// the expected ones or whose type types rejects is never committed. Stored
+// files get a metadata sidecar recording origin.
+func storeFile(store Storage, names *namer, types *typePolicy, filename, contentType string, src *checksumReader, origin uploadOrigin) uploadResult {
+	result := uploadResult{Filename: filename}
+	src.check = func(detected string) error { return types.check(detected, contentType, filename) }
+
+	var err error
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		result.Timestamp = time.Now()
+		result.StoredName = names.Name(filename, result.Timestamp)
+
+		// Collisions are detected before src is read, except when another
+		// writer takes the name meanwhile; src is consumed by then
+		result.Size, err = store.Put(result.StoredName, src)
+		if !errors.Is(err, fs.ErrExist) || src.started {
+			break
+		}
+		log.Printf("Name collision for %s, retrying", result.StoredName)
+	}
+
+	return uploadOutcome(store, result, src, contentType, origin, err)
+}
+
+// putFile streams src into store under exactly name. It replaces an
+// existing file when overwrite is set and fails with 412 otherwise.
+func putFile(store Storage, types *typePolicy, name, contentType string, src *checksumReader, overwrite bool, origin uploadOrigin) uploadResult {
+	result := uploadResult{Filename: name, StoredName: name, Timestamp: time.Now()}
+	src.check = func(detected string) error { return types.check(detected, contentType, name) }
+
+	var err error
+	if overwrite {
+		result.Size, err = store.Replace(name, src)
+	} else {
+		result.Size, err = store.Put(name, src)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		result.StoredName = ""
+		result.Status = http.StatusPreconditionFailed
+		result.Error = &apiError{Code: codeConflict, Message: "File already exists"}
+		return result
+	}
+	return uploadOutcome(store, result, src, contentType, origin, err)
+}
+
+// uploadOutcome completes result according to the error from storing it,
+// writing the metadata sidecar on success.
+func uploadOutcome(store Storage, result uploadResult, sums *checksumReader, contentType string, origin uploadOrigin, err error) uploadResult {
+	var maxErr *http.MaxBytesError
+	var typeErr *typeError
+	switch {
+	case err == nil:
+		result.Status = http.StatusOK
+		result.SHA256 = sums.sum(algSHA256)
+		result.MD5 = sums.sum(algMD5)
+		result.CRC32C = sums.sum(algCRC32C)
+		result.MimeType = declaredMimeType(contentType, result.StoredName)
+		result.DetectedMimeType = sums.detectedType()
+		writeMeta(store, result, origin)
+		log.Printf("File uploaded: %s", result.StoredName)
+		return result
+	case errors.As(err, &maxErr), errors.Is(err, errFileTooLarge):
+		result.Status = http.StatusRequestEntityTooLarge
+		result.Error = &apiError{Code: codeFileTooLarge, Message: "File too large"}
+	case errors.As(err, &typeErr):
+		result.Status = http.StatusUnsupportedMediaType
+		result.Error = &apiError{Code: codeUnsupportedMediaType, Message: typeErr.Error()}
+		log.Printf("Rejected upload of %s: %v", result.Filename, err)
+	case errors.Is(err, fs.ErrExist):
+		result.Status = http.StatusConflict
+		result.Error = &apiError{Code: codeConflict, Message: "Another upload took the name, please retry"}
+		log.Printf("Name collision for %s after upload: %v", result.StoredName, err)
+	case errors.Is(err, errChecksumMismatch):
+		result.Status = http.StatusBadRequest
+		result.Error = &apiError{Code: codeChecksumMismatch, Message: "File does not match the supplied checksum"}
+		log.Printf("Rejected upload of %s: %v", result.Filename, err)
+	default:
+		result.Status = http.StatusInternalServerError
+		result.Error = &apiError{Code: codeStorageError, Message: "Failed to save file"}
+		log.Printf("Failed to write file: %v", err)
+	}
+	result.StoredName = ""
+	result.Size = 0
+	return result
+}
+
+// declaredMimeType returns the client's Content-Type for the file, falling
+// back to a guess from the extension when it is missing or generic.
+func declaredMimeType(contentType, name string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return mimeTypeFor(name)
+	}
+	return mediaType
+}
+
+// writeUploadResults writes the per-file results, as JSON if requested and
+// one line per file otherwise. The status is 200 if every file was stored,
+// the first failure's status if none were, and 207 Multi-Status for a mix.
+func writeUploadResults(w http.ResponseWriter, r *http.Request, results []uploadResult) {
+	status := results[0].Status
+	for _, result := range results[1:] {
+		if (result.Status == http.StatusOK) != (status == http.StatusOK) {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, status, map[string][]uploadResult{"files": results})
+		return
+	}
+
+	lines := make([]string, 0, len(results))
+	for _, result := range results {
+		if result.Error == nil {
+			lines = append(lines, "File uploaded successfully: "+result.StoredName)
+		} else {
+			lines = append(lines, fmt.Sprintf("Failed to upload %s: %s", result.Filename, result.Error.Message))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, strings.Join(lines, "\n"))
+}
+
+// sizeLimitReader fails with errFileTooLarge once more than remaining bytes
+// have been read.
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMultipartUploadLimits(t *testing.T) {
+	store, _ := newFileStorage(t.TempDir())
+	names, _ := newNamer(defaultNameTemplate)
+	handler := uploadHandler(store, names, nil, nil, 1024)
+
+	post := func(write func(form *multipart.Writer)) (*httptest.ResponseRecorder, []uploadResult) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		write(form)
+		form.Close()
+		r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		var resp struct{ Files []uploadResult }
+		json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&resp)
+		return w, resp.Files
+	}
+
+	t.Run("files within MAX_SIZE are stored", func(t *testing.T) {
+		w, files := post(func(form *multipart.Writer) {
+			form.WriteField("tags", "a,b")
+			for i := 0; i < 3; i++ {
+				part, _ := form.CreateFormFile("file", fmt.Sprintf("part%d.txt", i))
+				part.Write(bytes.Repeat([]byte("x"), 1000))
+			}
+		})
+		if w.Code != http.StatusOK || len(files) != 3 {
+			t.Errorf("Expected 3 stored files, got %d %+v", w.Code, files)
+		}
+	})
+
+	t.Run("large form fields are rejected", func(t *testing.T) {
+		w, _ := post(func(form *multipart.Writer) {
+			form.WriteField("comment", strings.Repeat("x", maxFormFieldSize+1))
+			part, _ := form.CreateFormFile("file", "small.txt")
+			part.Write([]byte("small"))
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("request larger than its files may be is rejected", func(t *testing.T) {
+		w, files := post(func(form *multipart.Writer) {
+			// Many small fields add up beyond the total without any being too large
+			for i := 0; i*maxFormFieldSize < maxFormOverhead+maxFormFiles*1024; i++ {
+				form.WriteField("comment", strings.Repeat("x", maxFormFieldSize))
+			}
+			part, _ := form.CreateFormFile("file", "late.txt")
+			part.Write([]byte("late"))
+		})
+		if w.Code != http.StatusRequestEntityTooLarge || len(files) != 0 {
+			t.Errorf("Expected 413 and nothing stored, got %d %+v", w.Code, files)
+		}
+	})
+}